@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+
+	"../db"
+)
+
+// Checkpoint は途中まで取得したページの続きの位置と、取得済みの投稿
+// Urlは取得を開始したページ
+type Checkpoint struct {
+	Url     string
+	NextUrl string
+	Posts   []PostDto
+}
+
+// Checkpointer は取得の途中経過を保存し、次回の実行で続きから取得できるようにする
+// keyはCrawlJob.Key
+type Checkpointer interface {
+	Load(key string) (*Checkpoint, error)
+	Save(key string, cp *Checkpoint) error
+}
+
+// DbCheckpointer はcrawl_stateテーブルに途中経過を保存する
+// 取得が終わり、投稿を保存した時点で削除される(MyLogic.saveResult)
+// ページ数で打ち切った場合は続きのページを残し、次回はそこから取得する
+type DbCheckpointer struct {
+}
+
+func NewDbCheckpointer() *DbCheckpointer {
+	return &DbCheckpointer{}
+}
+
+func (c *DbCheckpointer) Load(key string) (*Checkpoint, error) {
+	var cp *Checkpoint
+
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		state, err := db.NewCrawlRepo(tc).GetState(key)
+		if err != nil || state == nil {
+			return err
+		}
+
+		cp = &Checkpoint{Url: state.Url, NextUrl: state.NextUrl}
+
+		return json.Unmarshal([]byte(state.Posts), &cp.Posts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+func (c *DbCheckpointer) Save(key string, cp *Checkpoint) error {
+	data, err := json.Marshal(cp.Posts)
+	if err != nil {
+		return err
+	}
+
+	return db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		return db.NewCrawlRepo(tc).SaveState(&db.CrawlState{
+			JobKey:  key,
+			Url:     cp.Url,
+			NextUrl: cp.NextUrl,
+			Posts:   string(data),
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+
+	"../db"
+)
+
+type memCheckpointer map[string]Checkpoint
+
+func (m memCheckpointer) Load(key string) (*Checkpoint, error) {
+	cp, ok := m[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &cp, nil
+}
+
+func (m memCheckpointer) Save(key string, cp *Checkpoint) error {
+	m[key] = Checkpoint{Url: cp.Url, NextUrl: cp.NextUrl, Posts: append([]PostDto(nil), cp.Posts...)}
+
+	return nil
+}
+
+// failFetcher はfailに含まれるURLの取得に失敗し、取得したURLを記録する
+type failFetcher struct {
+	fetcher Fetcher
+	fail    map[string]bool
+	fetched []string
+}
+
+func (f *failFetcher) Fetch(rawurl string) (*goquery.Document, error) {
+	f.fetched = append(f.fetched, rawurl)
+
+	if f.fail[rawurl] {
+		return nil, errors.New("connection reset by peer")
+	}
+
+	return f.fetcher.Fetch(rawurl)
+}
+
+func TestGetPageResumesFromCheckpoint(t *testing.T) {
+	const start = "http://textream.yahoo.co.jp/personal/history/comment?user=testuser"
+	const page2 = "http://textream.yahoo.co.jp/personal/history/comment?user=testuser&offset=3"
+
+	f := &failFetcher{
+		fetcher: NewFileFetcher("testdata/crawl"),
+		fail:    map[string]bool{page2: true},
+	}
+	cps := memCheckpointer{}
+	p := NewPageParser(f, nil, cps)
+
+	mark := db.CrawlWatermark{Url: "http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6/12345"}
+
+	_, _, _, err := p.getPage("user/1", start, mark, 0)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	cp, ok := cps["user/1"]
+	if !ok {
+		t.Fatal("checkpoint not saved")
+	}
+	if cp.NextUrl != page2 || len(cp.Posts) != 2 {
+		t.Errorf("checkpoint = %s, %d posts; want %s, 2 posts", cp.NextUrl, len(cp.Posts), page2)
+	}
+
+	f.fail = nil
+	f.fetched = nil
+
+	posts, _, _, err := p.getPage("user/1", start, mark, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.fetched) != 1 || f.fetched[0] != page2 {
+		t.Errorf("fetched %v, want only %s", f.fetched, page2)
+	}
+
+	checkGolden(t, "testdata/crawl.golden.json", posts)
+}
+
+// 開始URLが変わった場合は前の途中経過を使わずに最初から取得する
+func TestGetPageIgnoresCheckpointOfOtherUrl(t *testing.T) {
+	const start = "http://textream.yahoo.co.jp/personal/history/comment?user=testuser"
+	const page2 = "http://textream.yahoo.co.jp/personal/history/comment?user=testuser&offset=3"
+
+	f := &failFetcher{fetcher: NewFileFetcher("testdata/crawl")}
+	cps := memCheckpointer{
+		"user/1": {Url: "http://textream.yahoo.co.jp/personal/history/comment?user=olduser", NextUrl: page2, Posts: []PostDto{{Url: "http://example.com/old"}}},
+	}
+	p := NewPageParser(f, nil, cps)
+
+	mark := db.CrawlWatermark{Url: "http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6/12345"}
+
+	posts, _, _, err := p.getPage("user/1", start, mark, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.fetched) == 0 || f.fetched[0] != start {
+		t.Errorf("fetched %v, want to start from %s", f.fetched, start)
+	}
+
+	checkGolden(t, "testdata/crawl.golden.json", posts)
+}
+
+func TestCrawlJobKey(t *testing.T) {
+	user := db.UserPostTimeView{Id: 3}
+	brand := &db.Brand{Id: 5}
+
+	tests := []struct {
+		job  CrawlJob
+		want string
+	}{
+		{CrawlJob{User: user}, "user/3"},
+		{CrawlJob{User: user, FullHistory: true}, "user/3/backfill"},
+		{CrawlJob{Brand: brand}, "brand/5"},
+	}
+
+	for _, test := range tests {
+		if got := test.job.Key(); got != test.want {
+			t.Errorf("Key() = %s, want %s", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"../db"
+)
+
+// Crawler は決まった数のワーカーでユーザーのページを取得する
+// ユーザー数が多くても、ワーカー数以上のgoroutineは作らない
+type Crawler struct {
+	fetcher     Fetcher
+	retry       *RetryPolicy
+	checkpoints Checkpointer
+	workers     int
+	queueSize   int
+	// 前回の取得位置がない場合に遡る日数。0以下の場合は全て取得する
+	lookbackDays int
+}
+
+func NewCrawler(fetcher Fetcher, retry *RetryPolicy, checkpoints Checkpointer, workers int, queueSize int) *Crawler {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	return &Crawler{
+		fetcher:      fetcher,
+		retry:        retry,
+		checkpoints:  checkpoints,
+		workers:      workers,
+		queueSize:    queueSize,
+		lookbackDays: 365,
+	}
+}
+
+// CrawlJob は取得するページと、そのページの前回の取得位置
+// Brandがnilでない場合は銘柄の掲示板、それ以外はUserのページを取得する
+// FullHistoryがtrueの場合は前回の取得位置に関係なく最後のページ(MaxPagesが0より大きい場合はそのページ数)まで取得する
+type CrawlJob struct {
+	Url         string
+	User        db.UserPostTimeView
+	Brand       *db.Brand
+	Watermark   db.CrawlWatermark
+	FullHistory bool
+	MaxPages    int
+}
+
+// Key は途中経過を保存するキー
+// 同じユーザーでも-backfillと通常の取得は別々に中断、再開する
+func (j *CrawlJob) Key() string {
+	key := fmt.Sprintf("user/%d", j.User.Id)
+	if j.Brand != nil {
+		key = fmt.Sprintf("brand/%d", j.Brand.Id)
+	}
+
+	if j.FullHistory {
+		key += "/backfill"
+	}
+
+	return key
+}
+
+// Run は取得結果を終わったものから返す。全ユーザー分を返すとチャネルは閉じられる
+func (c *Crawler) Run(jobs []CrawlJob) <-chan PageResult {
+	queue := make(chan CrawlJob, c.queueSize)
+	results := make(chan PageResult, c.workers)
+
+	go func() {
+		for _, job := range jobs {
+			queue <- job
+		}
+		close(queue)
+	}()
+
+	done := make(chan struct{})
+	for i := 0; i < c.workers; i++ {
+		go func() {
+			p := NewPageParser(c.fetcher, c.retry, c.checkpoints)
+
+			for job := range queue {
+				results <- c.crawl(p, job)
+			}
+
+			done <- struct{}{}
+		}()
+	}
+
+	go func() {
+		for i := 0; i < c.workers; i++ {
+			<-done
+		}
+		close(results)
+	}()
+
+	return results
+}
+
+func (c *Crawler) crawl(p *PageParser, job CrawlJob) PageResult {
+	mark := job.Watermark
+	if job.FullHistory {
+		mark = db.CrawlWatermark{}
+	} else if mark.Url == "" && mark.PostTime.IsZero() && c.lookbackDays > 0 {
+		mark.PostTime = time.Now().AddDate(0, 0, -c.lookbackDays)
+	}
+
+	posts, attempts, truncated, err := p.getPage(job.Key(), job.Url, mark, job.MaxPages)
+
+	// 掲示板のページには銘柄名が表示されない
+	if job.Brand != nil {
+		for i := range posts {
+			posts[i].BrandName = job.Brand.BrandName
+			posts[i].BrandUrl = job.Brand.Url
+		}
+	}
+
+	return PageResult{
+		Job:       job,
+		Posts:     posts,
+		Attempts:  attempts,
+		Truncated: truncated,
+		Err:       err,
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"../db"
+	"../util"
+)
+
+func TestCrawlerRun(t *testing.T) {
+	c := NewCrawler(NewFileFetcher("testdata/crawl"), nil, nil, 2, 0)
+
+	jobs := make([]CrawlJob, 10)
+	for i := range jobs {
+		jobs[i] = CrawlJob{
+			Url: "http://textream.yahoo.co.jp/personal/history/comment?user=testuser",
+			User: db.UserPostTimeView{
+				Id:      i + 1,
+				YahooId: fmt.Sprintf("user%d", i+1),
+				Url:     "http://textream.yahoo.co.jp/personal/history/comment?user=testuser",
+			},
+			Watermark: db.CrawlWatermark{
+				UserId:   i + 1,
+				PostTime: time.Date(2014, 5, 20, 15, 5, 0, 0, util.SiteLocation),
+			},
+		}
+	}
+	// fixtureがないユーザーは失敗する
+	jobs[3].Url = "http://textream.yahoo.co.jp/personal/history/comment?user=nobody"
+
+	seen := make(map[int]bool)
+	for result := range c.Run(jobs) {
+		if seen[result.Job.User.Id] {
+			t.Errorf("user %d returned twice", result.Job.User.Id)
+		}
+		seen[result.Job.User.Id] = true
+
+		if result.Job.User.Id == 4 {
+			if result.Err == nil {
+				t.Errorf("user 4: expected error")
+			}
+			continue
+		}
+
+		if result.Err != nil {
+			t.Errorf("user %d: %v", result.Job.User.Id, result.Err)
+		}
+		if len(result.Posts) != 3 {
+			t.Errorf("user %d: len(posts) = %d, want 3", result.Job.User.Id, len(result.Posts))
+		}
+	}
+
+	if len(seen) != len(jobs) {
+		t.Errorf("got %d results, want %d", len(seen), len(jobs))
+	}
+}
+
+func TestCrawlerBoard(t *testing.T) {
+	c := NewCrawler(NewFileFetcher("testdata/crawl"), nil, nil, 1, 0)
+
+	brand := &db.Brand{Id: 1, BrandName: "(株)ＳＵＭＣＯ", Url: "http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6"}
+	jobs := []CrawlJob{{
+		Url:   brand.Url,
+		Brand: brand,
+		Watermark: db.CrawlWatermark{
+			Url:      brand.Url + "/12350",
+			PostTime: time.Date(2014, 5, 21, 10, 30, 0, 0, util.SiteLocation),
+		},
+	}}
+
+	for result := range c.Run(jobs) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+
+		if len(result.Posts) != 2 {
+			t.Errorf("len(posts) = %d, want 2", len(result.Posts))
+		}
+
+		for _, post := range result.Posts {
+			if post.BrandName != brand.BrandName || post.BrandUrl != brand.Url {
+				t.Errorf("%s: brand = %q, %q; want %q, %q", post.Url, post.BrandName, post.BrandUrl, brand.BrandName, brand.Url)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Fetcher はURLで指定されたページを取得する
+type Fetcher interface {
+	Fetch(rawurl string) (*goquery.Document, error)
+}
+
+// HttpFetcher はHTTPでページを取得する
+type HttpFetcher struct {
+	client *http.Client
+}
+
+func NewHttpFetcher(client *http.Client) *HttpFetcher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &HttpFetcher{client: client}
+}
+
+func (f *HttpFetcher) Fetch(rawurl string) (*goquery.Document, error) {
+	res, err := f.client.Get(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+
+		return nil, &HttpError{
+			StatusCode: res.StatusCode,
+			RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	return goquery.NewDocumentFromResponse(res)
+}
+
+// HttpError は200以外のステータスが返ってきたことを表す
+type HttpError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *HttpError) Error() string {
+	return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Retry-Afterは秒数かHTTP日付のどちらか
+func parseRetryAfter(s string, now time.Time) time.Duration {
+	if s == "" {
+		return 0
+	}
+
+	if sec, err := strconv.Atoi(s); err == nil {
+		if sec < 0 {
+			return 0
+		}
+		return time.Duration(sec) * time.Second
+	}
+
+	if t, err := http.ParseTime(s); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
+// FileFetcher は保存済みのHTMLファイルからページを取得する
+//
+// http://host/path?query は dir/host/path_query.html に対応する
+// (queryはURLエンコードされる。pathが/で終わる場合はindexを補う)
+type FileFetcher struct {
+	dir string
+}
+
+func NewFileFetcher(dir string) *FileFetcher {
+	return &FileFetcher{dir: dir}
+}
+
+func (f *FileFetcher) Fetch(rawurl string) (*goquery.Document, error) {
+	path, err := f.Path(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return goquery.NewDocumentFromReader(r)
+}
+
+func (f *FileFetcher) Path(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	name := u.Path
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index"
+	}
+
+	if u.RawQuery != "" {
+		name += "_" + url.QueryEscape(u.RawQuery)
+	}
+
+	return filepath.Join(f.dir, u.Host, filepath.FromSlash(name)+".html"), nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../db"
+)
+
+// testPage は投稿が1件のページ。nextが空でない場合は次のページへのリンクを付ける
+func testPage(no int, next string) string {
+	var b strings.Builder
+	b.WriteString(`<html><body><ul class="commentList"><li class="commentBox">`)
+	b.WriteString(`<div class="breadcrumbs"><ul><li><a href="http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6">(株)ＳＵＭＣＯ</a></li></ul></div>`)
+	fmt.Fprintf(&b, `<div class="commentHeaderInfo"><div class="comNum">No.%d</div><h2><a href="http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6/%d">title%d</a></h2></div>`, no, no, no)
+	fmt.Fprintf(&b, `<div class="ttlInfoDateNum"><p>2014/05/%02d 15:04</p></div>`, 20-no)
+	b.WriteString(`<div class="detail"><p>detail</p></div></li></ul>`)
+	if next != "" {
+		fmt.Fprintf(&b, `<a href="%s">次のページ</a>`, next)
+	}
+	b.WriteString(`</body></html>`)
+
+	return b.String()
+}
+
+func TestHttpFetcherPagination(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		switch r.URL.Query().Get("offset") {
+		case "":
+			fmt.Fprint(w, testPage(1, ts.URL+"/comment?offset=1"))
+		case "1":
+			fmt.Fprint(w, testPage(2, ts.URL+"/comment?offset=2"))
+		case "2":
+			fmt.Fprint(w, testPage(3, ""))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	p := NewPageParser(NewHttpFetcher(nil), nil, nil)
+
+	posts, attempts, _, err := p.getPage("", ts.URL+"/comment", db.CrawlWatermark{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nos := make([]string, len(posts))
+	for i, post := range posts {
+		nos[i] = post.CommentNo
+	}
+
+	if got := strings.Join(nos, ","); got != "1,2,3" || attempts != 3 {
+		t.Errorf("comment nos = %s, attempts = %d; want 1,2,3, 3", got, attempts)
+	}
+}
+
+func TestHttpFetcherError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	_, err := NewHttpFetcher(nil).Fetch(ts.URL)
+
+	he, ok := err.(*HttpError)
+	if !ok || he.StatusCode != http.StatusServiceUnavailable || he.RetryAfter != 2*time.Minute {
+		t.Errorf("Fetch() error = %#v", err)
+	}
+}
+
+func TestFileFetcherPath(t *testing.T) {
+	f := NewFileFetcher("testdata/crawl")
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://textream.yahoo.co.jp/personal/history/comment?user=testuser", "textream.yahoo.co.jp/personal/history/comment_user%3Dtestuser.html"},
+		{"http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6", "textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6.html"},
+		{"http://example.com/", "example.com/index.html"},
+		{"http://example.com", "example.com/index.html"},
+	}
+
+	for _, tt := range tests {
+		got, err := f.Path(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := filepath.Join("testdata/crawl", filepath.FromSlash(tt.want)); got != want {
+			t.Errorf("Path(%s) = %s, want %s", tt.url, got, want)
+		}
+	}
+
+	if _, err := f.Fetch("http://example.com/none"); !os.IsNotExist(err) {
+		t.Errorf("Fetch() error = %v, want not exist", err)
+	}
+}
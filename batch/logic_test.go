@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../db"
+	"../util"
+)
+
+// DBを使うテストは一時ディレクトリのsqlite3のDBで行う
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "yahoo_textream")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	util.Cfg.DBFile = filepath.Join(dir, "data.db")
+	util.Cfg.AutoMigrate = true
+
+	if err = db.Open(); err != nil {
+		log.Fatalln(err)
+	}
+
+	code := m.Run()
+
+	db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// uniqueName は-countで繰り返し実行しても前回のデータと重複しない名前を返す
+func uniqueName(prefix string) string {
+	return fmt.Sprintf("%s_%d", prefix, time.Now().UnixNano())
+}
+
+// addTestUser はユーザーを登録し、登録されたユーザーを返す
+func addTestUser(t *testing.T, name string) *db.User {
+	var user *db.User
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		var err error
+		user, err = db.NewUserRepo(tc).AddIfNotExist(&db.User{YahooId: name, Url: "http://example.com/" + name})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// 同じ投稿を保存し直しても新規投稿にならない
+func TestSavePostsAgain(t *testing.T) {
+	name := uniqueName("save")
+	brandUrl := "http://example.com/" + name + "/brand"
+	posts := []PostDto{
+		{BrandName: name, BrandUrl: brandUrl, CommentNo: "1", Title: "t", Url: brandUrl + "/1", Detail: "d", PostTime: time.Date(2014, 6, 1, 9, 0, 0, 0, time.UTC)},
+		{BrandName: name, BrandUrl: brandUrl, CommentNo: "2", Title: "t", Url: brandUrl + "/2", Detail: "d", PostTime: time.Date(2014, 6, 1, 10, 0, 0, 0, time.UTC)},
+	}
+
+	user := addTestUser(t, name)
+
+	var count int64
+	for i, want := range []int{2, 0} {
+		var added []int
+		err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+			var err error
+			added, err = NewMyLogic(tc).savePosts(user.Id, posts)
+			if err != nil {
+				return err
+			}
+
+			count, err = tc.Tx.SelectInt("select count(*) from post where user_id=?", user.Id)
+
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(added) != want || count != 2 {
+			t.Errorf("run %d: added = %v, post count = %d; want %d added, 2 posts", i+1, added, count, want)
+		}
+	}
+}
+
+// 投稿がなくても取得が終わったら途中経過を削除する
+func TestSaveResultWithoutPosts(t *testing.T) {
+	user := addTestUser(t, uniqueName("state"))
+
+	job := CrawlJob{Url: user.Url, User: db.UserPostTimeView{Id: user.Id, YahooId: user.YahooId, Url: user.Url}}
+
+	cps := NewDbCheckpointer()
+	for _, key := range []string{job.Key(), job.Key() + "/backfill"} {
+		if err := cps.Save(key, &Checkpoint{Url: user.Url, NextUrl: user.Url + "?offset=10"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		_, err := NewMyLogic(tc).saveResult(&PageResult{Job: job})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cp, err := cps.Load(job.Key()); err != nil || cp != nil {
+		t.Errorf("Load(%s) = %+v, %v; want nil", job.Key(), cp, err)
+	}
+
+	// -backfillの途中経過は別
+	if cp, err := cps.Load(job.Key() + "/backfill"); err != nil || cp == nil || cp.Url != user.Url {
+		t.Errorf("Load(%s/backfill) = %+v, %v", job.Key(), cp, err)
+	}
+}
+
+// -backfillをページ数で打ち切った場合、次回は続きのページから取得する
+func TestBackfillContinuesAfterMaxPages(t *testing.T) {
+	const start = "http://textream.yahoo.co.jp/personal/history/comment?user=testuser"
+	const page2 = "http://textream.yahoo.co.jp/personal/history/comment?user=testuser&offset=3"
+	const page3 = "http://textream.yahoo.co.jp/personal/history/comment?user=testuser&offset=6"
+
+	name := uniqueName("backfill")
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		return db.NewUserRepo(tc).Add(&db.User{YahooId: name, Url: start, Active: true})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &failFetcher{fetcher: NewFileFetcher("testdata/crawl")}
+	crawler := NewCrawler(f, nil, NewDbCheckpointer(), 1, 1)
+
+	// 1ページずつ取得し、続きのページを途中経過に残す
+	tests := []struct {
+		fetched string
+		next    string
+	}{
+		{start, page2},
+		{page2, page3},
+	}
+
+	for i, test := range tests {
+		f.fetched = nil
+
+		if err = runBackfill(crawler, name, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(f.fetched) != 1 || f.fetched[0] != test.fetched {
+			t.Errorf("run %d: fetched %v, want %s", i+1, f.fetched, test.fetched)
+		}
+
+		var state *db.CrawlState
+		err = db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+			user, err := db.NewUserRepo(tc).GetByYahooId(name)
+			if err != nil {
+				return err
+			}
+
+			job := CrawlJob{User: db.UserPostTimeView{Id: user.Id}, FullHistory: true}
+			state, err = db.NewCrawlRepo(tc).GetState(job.Key())
+
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if state == nil || state.NextUrl != test.next {
+			t.Errorf("run %d: checkpoint = %+v, want %s", i+1, state, test.next)
+		}
+	}
+}
+
+// 画面で登録できないユーザーは-importでも登録しない
+func TestImportUsersValidation(t *testing.T) {
+	name := uniqueName("import")
+	page := util.USER_PAGE_URL + "?user=" + name
+
+	tests := []struct {
+		user UserJson
+		ok   bool
+	}{
+		{UserJson{YahooId: name, Url: page}, true},
+		{UserJson{YahooId: name, Url: "http://example.com/" + name}, false},
+		{UserJson{YahooId: name + "_other", Url: page}, false},
+		{UserJson{YahooId: "", Url: page}, false},
+	}
+
+	for _, test := range tests {
+		err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+			_, _, err := NewMyLogic(tc).importUsers([]UserJson{test.user})
+			return err
+		})
+		if (err == nil) != test.ok {
+			t.Errorf("importUsers(%+v) = %v", test.user, err)
+		}
+	}
+}
@@ -1,20 +1,26 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	neturl "net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 
 	"../db"
+	"../util"
+	"../watch"
 )
 
 type UserJson struct {
@@ -35,195 +41,598 @@ type PostDto struct {
 	RefUrl    string
 	Detail    string
 	PostTime  time.Time
+	// 掲示板のページでのみ取得できる
+	AuthorId   string
+	AuthorName string
+	AuthorUrl  string
 }
 
-const USER_JSON = "./users.json"
+var (
+	fixtureDir = flag.String("fixtures", "", "保存済みHTMLのディレクトリ(指定時はサイトにアクセスしない)")
+	daemon     = flag.Bool("daemon", false, "常駐して設定したスケジュールで繰り返し取得する")
+	backfill   = flag.String("backfill", "", "指定したYahoo IDのユーザー(allの場合は全ユーザー)の全ての投稿を取得する")
+	maxPages   = flag.Int("maxpages", 0, "-backfillで1回に取得する最大ページ数(次回は続きから取得する。0の場合は設定ファイルのbackfillmaxpages)")
+	importFile = flag.String("import", "", "指定したJSONファイル(users.json.sampleの形式)のユーザーを取得対象として登録して終了する")
+)
 
 func main() {
-	runtime.GOMAXPROCS(3)
+	flag.Parse()
+	util.LoadConfig()
 
-	us := readUsersFromJson()
+	if util.Cfg.Crawler.GoMaxProcs > 0 {
+		runtime.GOMAXPROCS(util.Cfg.Crawler.GoMaxProcs)
+	}
 
-	var users []db.UserPostTimeView
+	err := db.Open()
+	if err != nil {
+		exit(err)
+	}
 
-	container := db.NewTxContainer()
-	container.Do(func(tc *db.TxContainer) error {
-		var err error
+	defer db.Close()
 
-		l := NewMyLogic(tc)
+	if *importFile != "" {
+		err = importUsers(*importFile)
+		if err != nil {
+			exit(err)
+		}
+		return
+	}
 
-		l.addUsersIfNotExist(us)
+	var fetcher Fetcher
+	if *fixtureDir != "" {
+		fetcher = NewFileFetcher(*fixtureDir)
+	} else {
+		rl := util.Cfg.Crawler.RateLimit
+
+		// 全てのPageParserで共有して、並列数に関係なくサイトへのリクエスト頻度を抑える
+		fetcher = NewRateLimitedFetcher(
+			NewHttpFetcher(&http.Client{
+				Timeout: time.Duration(util.Cfg.Crawler.TimeoutMsec) * time.Millisecond,
+			}),
+			NewRateLimiter(rl.RequestsPerSec, rl.Burst, rl.PerHost),
+		)
+	}
+
+	notifier, err := NewNotifier(util.Cfg.Notifier, NewDbDeliveryLog())
+	if err != nil {
+		exit(err)
+	}
+
+	cc := util.Cfg.Crawler
+	crawler := NewCrawler(fetcher, NewRetryPolicy(cc.Retry), NewDbCheckpointer(), cc.Workers, cc.QueueSize)
+	crawler.lookbackDays = cc.LookbackDays
+
+	if *daemon {
+		runDaemon(crawler, notifier)
+		notifier.Close()
+		return
+	}
+
+	if *backfill != "" {
+		pages := *maxPages
+		if pages <= 0 {
+			pages = cc.BackfillMaxPages
+		}
 
-		users, err = l.getUsers()
+		err = runBackfill(crawler, *backfill, pages)
+		if err != nil {
+			exit(err)
+		}
+		return
+	}
+
+	err = runOnce(crawler, notifier)
+
+	// 送信待ちの通知を送ってから終了する
+	notifier.Close()
+
+	if err != nil {
+		exit(err)
+	}
+}
+
+func runDaemon(crawler *Crawler, notifier *Notifier) {
+	schedule, err := NewSchedule(util.Cfg.Crawler.Schedule)
+	if err != nil {
+		exit(err)
+	}
+
+	s := NewScheduler(schedule, func() {
+		log.Println("crawl started")
+
+		err := runOnce(crawler, notifier)
+		if err != nil {
+			log.Println(err)
+		}
+
+		log.Println("crawl finished")
+	})
+
+	stop := make(chan struct{})
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Println("stopping after the current crawl ...")
+		close(stop)
+	}()
+
+	s.Run(stop)
+}
+
+func runOnce(crawler *Crawler, notifier *Notifier) error {
+	users, marks, err := loadUsers()
+	if err != nil {
+		return err
+	}
+
+	var brands []db.Brand
+	var boardMarks map[int]db.BoardWatermark
+
+	err = db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		var err error
+
+		brands, err = db.NewBrandRepo(tc).GetByIds(util.Cfg.Crawler.Boards)
+		if err != nil {
+			return err
+		}
+
+		boardMarks, err = db.NewCrawlRepo(tc).GetBoardWatermarks()
 		if err != nil {
 			return err
 		}
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	ch := make(chan PageResult, len(users))
-	chP := make(chan PageParser, 3)
-	for i := 0; i < 3; i++ {
-		chP <- PageParser{}
+	jobs := make([]CrawlJob, 0, len(users)+len(brands))
+	for _, u := range users {
+		mark, ok := marks[u.Id]
+		if !ok {
+			// 取得位置を保存する前の投稿しかない場合は、最後の投稿日時から取得する
+			mark = db.CrawlWatermark{UserId: u.Id, PostTime: u.PostTime}
+		}
+
+		jobs = append(jobs, CrawlJob{Url: u.Url, User: u, Watermark: mark})
 	}
 
-	for _, user := range users {
-		go func(c chan<- PageResult, cp chan PageParser, u db.UserPostTimeView) {
-			var lastPostTime time.Time
-			if u.PostTime.IsZero() {
-				lastPostTime = time.Now().AddDate(-1, 0, 0)
-			} else {
-				lastPostTime = u.PostTime
-			}
+	for i := range brands {
+		b := &brands[i]
+		bm := boardMarks[b.Id]
+
+		jobs = append(jobs, CrawlJob{
+			Url:   b.Url,
+			Brand: b,
+			Watermark: db.CrawlWatermark{
+				Url:       bm.Url,
+				CommentNo: bm.CommentNo,
+				PostTime:  bm.PostTime,
+			},
+		})
+	}
 
-			p := <-cp
+	return runJobs(crawler, jobs, notifier)
+}
 
-			posts := p.getPage(u.Url, lastPostTime)
+// target(Yahoo ID、allの場合は全ユーザー)の投稿を、前回の取得位置に関係なく最初から取得する
+// maxPagesが0より大きい場合は、そのページ数で打ち切り、次回の-backfillで続きから取得する
+func runBackfill(crawler *Crawler, target string, maxPages int) error {
+	users, marks, err := loadUsers()
+	if err != nil {
+		return err
+	}
 
-			cp <- p
+	jobs := make([]CrawlJob, 0, len(users))
+	for _, u := range users {
+		if target != "all" && u.YahooId != target {
+			continue
+		}
 
-			ch <- PageResult{
-				User:  u,
-				Posts: posts,
-			}
-		}(ch, chP, user)
+		jobs = append(jobs, CrawlJob{
+			Url:         u.Url,
+			User:        u,
+			Watermark:   marks[u.Id],
+			FullHistory: true,
+			MaxPages:    maxPages,
+		})
 	}
 
-	for i := 0; i < len(users); i++ {
-		result := <-ch
-		var displayName string
-		if result.User.DisplayName.Valid {
-			displayName = result.User.DisplayName.String
-		} else {
-			displayName = result.User.YahooId
+	if len(jobs) == 0 {
+		return fmt.Errorf("user not found : %s", target)
+	}
+
+	// 過去の投稿の取り込みなので通知しない
+	return runJobs(crawler, jobs, nil)
+}
+
+// 取得対象(active)のユーザーと前回の取得位置を返す
+// 掲示板の取得で追加されたユーザーは、画面で取得対象にしない限り個別には取得しない
+func loadUsers() ([]db.UserPostTimeView, map[int]db.CrawlWatermark, error) {
+	var users []db.UserPostTimeView
+	var marks map[int]db.CrawlWatermark
+
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		var err error
+
+		users, err = db.NewUserRepo(tc).List(db.UserFilter{Active: true})
+		if err != nil {
+			return err
 		}
 
-		fmt.Printf("%s(%s): %v\n", displayName, result.User.YahooId, result.User.PostTime)
+		marks, err = db.NewCrawlRepo(tc).GetWatermarks()
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return users, marks, nil
+}
+
+// notifierがnilの場合は新規投稿を通知しない
+func runJobs(crawler *Crawler, jobs []CrawlJob, notifier *Notifier) error {
+	container := db.NewTxContainer()
+
+	failed := make([]PageResult, 0)
+
+	for result := range crawler.Run(jobs) {
+		fmt.Printf("%s: %v\n", result.label(), result.Job.Watermark.PostTime.In(util.DisplayLocation))
+		fmt.Printf("リクエスト : %d回\n", result.Attempts)
+
+		if result.Err != nil {
+			fmt.Printf("取得失敗 : %v\n\n", result.Err)
+			failed = append(failed, result)
+			continue
+		}
 
 		if len(result.Posts) > 0 {
 			fmt.Printf("新規投稿 :　%d件\n-----\n", len(result.Posts))
 
 			for _, post := range result.Posts {
-				fmt.Printf("%s\n%s\n%s\n%v\n-----\n", post.BrandName, post.Title, post.Url, post.PostTime)
+				fmt.Printf("%s\n%s\n%s\n%v\n-----\n", post.BrandName, post.Title, post.Url, post.PostTime.In(util.DisplayLocation))
 			}
+		}
 
-			container.Do(func(tc *db.TxContainer) error {
-				NewMyLogic(tc).savePosts(result.User.Id, result.Posts)
+		// 投稿がない場合も途中経過を削除する
+		var added []int
+		result.Err = container.Do(func(tc *db.TxContainer) error {
+			var err error
+			added, err = NewMyLogic(tc).saveResult(&result)
 
-				return nil
-			})
+			return err
+		})
+		if result.Err != nil {
+			fmt.Printf("保存失敗 : %v\n", result.Err)
+			failed = append(failed, result)
+		} else if len(result.Posts) > 0 {
+			fmt.Printf("保存 : %d件 (保存済み %d件)\n", len(added), len(result.Posts)-len(added))
+
+			// 通知に失敗しても保存済みなので、取得の失敗にはしない(送信の結果は待たない)
+			if notifier != nil && len(added) > 0 {
+				if err := notifyPosts(notifier, result.label(), added); err != nil {
+					fmt.Printf("通知失敗 : %v\n", err)
+				}
+			}
 		} else {
 			fmt.Printf("投稿なし\n")
 		}
 
 		fmt.Println()
 	}
+
+	fmt.Printf("成功 : %d件 / 失敗 : %d件\n", len(jobs)-len(failed), len(failed))
+
+	for _, result := range failed {
+		fmt.Printf("  %s: %v (リクエスト %d回)\n", result.label(), result.Err, result.Attempts)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d件の取得で失敗しました", len(failed))
+	}
+
+	return nil
+}
+
+// 新規に保存した投稿を通知する
+func notifyPosts(notifier *Notifier, source string, ids []int) error {
+	if len(notifier.channels) == 0 {
+		return nil
+	}
+
+	ps := make([]db.PostView, 0, len(ids))
+
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		repo := db.NewPostRepo(tc)
+
+		for _, id := range ids {
+			p, err := repo.GetView(id)
+			if err != nil {
+				return err
+			}
+
+			if p != nil {
+				ps = append(ps, *p)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !notifier.Enqueue(NewNotification(source, ps)) {
+		return errors.New("通知を送信待ちに追加できませんでした(送信失敗として記録しました)")
+	}
+
+	return nil
+}
+
+// 取得した投稿のうち最新のもの。同じ分の投稿はページの上にある方が新しい
+func latestPost(posts []PostDto) PostDto {
+	latest := posts[0]
+	for _, post := range posts[1:] {
+		if post.PostTime.After(latest.PostTime) {
+			latest = post
+		}
+	}
+
+	return latest
 }
 
 type PageResult struct {
-	User  db.UserPostTimeView
-	Posts []PostDto
+	Job      CrawlJob
+	Posts    []PostDto
+	Attempts int
+	// CrawlJob.MaxPagesで打ち切った場合true
+	Truncated bool
+	Err       error
+}
+
+func (r *PageResult) label() string {
+	if r.Job.Brand != nil {
+		return fmt.Sprintf("%s(掲示板)", r.Job.Brand.BrandName)
+	}
+
+	u := r.Job.User
+	if u.DisplayName.Valid {
+		return fmt.Sprintf("%s(%s)", u.DisplayName.String, u.YahooId)
+	}
+
+	return fmt.Sprintf("%s(%s)", u.YahooId, u.YahooId)
 }
 
-func readUsersFromJson() []UserJson {
-	f, err := os.Open(USER_JSON)
+// importUsers はJSONファイルのユーザーを取得対象として登録する
+func importUsers(path string) error {
+	us, err := readUsersFromJson(path)
 	if err != nil {
-		exit(err)
+		return err
+	}
+
+	return db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		added, updated, err := NewMyLogic(tc).importUsers(us)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("追加 : %d件 / 更新 : %d件\n", added, updated)
+
+		return nil
+	})
+}
+
+func readUsersFromJson(path string) ([]UserJson, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
 
 	defer f.Close()
 
 	data, err := ioutil.ReadAll(f)
 	if err != nil {
-		exit(err)
+		return nil, err
 	}
 
 	var users []UserJson
 
 	err = json.Unmarshal(data, &users)
 	if err != nil {
-		exit(err)
+		return nil, err
 	}
 
-	return users
+	return users, nil
 }
 
 type PageParser struct {
+	fetcher     Fetcher
+	retry       *RetryPolicy
+	checkpoints Checkpointer
 }
 
-func (p *PageParser) getPage(url string, lastPostTime time.Time) []PostDto {
-	list := make([]PostDto, 0)
+// retryがnilの場合はリトライしない。checkpointsがnilの場合は途中経過を保存しない
+func NewPageParser(fetcher Fetcher, retry *RetryPolicy, checkpoints Checkpointer) *PageParser {
+	return &PageParser{fetcher: fetcher, retry: retry, checkpoints: checkpoints}
+}
 
-	skip := false
+// 途中のページで失敗した場合は、取得済みの投稿も返さない
+// (新しい投稿だけ保存すると、次回以降それより古い未取得の投稿が取得されなくなるため)
+// 代わりにページごとに途中経過を保存し、次回はその続きのページから取得する
+// keyは途中経過を保存するキー(CrawlJob.Key)
+// maxPagesが0より大きい場合は、そのページ数で打ち切り、次回はその続きのページから取得する
+// 2つ目の戻り値はリトライを含めたリクエスト回数、3つ目はmaxPagesで打ち切った場合true
+func (p *PageParser) getPage(key string, url string, mark db.CrawlWatermark, maxPages int) ([]PostDto, int, bool, error) {
+	start := url
+	list := make([]PostDto, 0)
+	attempts := 0
+	pages := 0
 
-	for {
-		doc, err := goquery.NewDocument(url)
+	if p.checkpoints != nil {
+		cp, err := p.checkpoints.Load(key)
 		if err != nil {
-			exit(err)
+			return nil, attempts, false, err
 		}
 
-		doc.Find("li.commentBox").EachWithBreak(func(_ int, sel *goquery.Selection) bool {
-			post := PostDto{}
-
-			anchor := sel.Find("div.breadcrumbs ul li a")
-			post.BrandUrl, post.BrandName, _ = p.getHrefAndText(anchor)
-
-			post.CommentNo, _ = p.trimCommentNo(sel.Find("div.commentHeaderInfo div").Text())
-			anchor2 := sel.Find("div.commentHeaderInfo h2 a")
-			post.Url, post.Title, _ = p.getHrefAndText(anchor2)
+		// 開始URLが変更された場合は、前の途中経過を使わない
+		if cp != nil && cp.Url == start {
+			log.Printf("%s : resume from %s (%d posts)", key, cp.NextUrl, len(cp.Posts))
+			url = cp.NextUrl
+			list = append(list, cp.Posts...)
+		}
+	}
 
-			uptime := sel.Find("div.ttlInfoDateNum p").Text()
-			// 取得した日時は+09:00 JST
-			post.PostTime, _ = time.ParseInLocation("2006/01/02 15:04", uptime, time.Local)
+	// 取得中に新しい投稿があるとページがずれて同じ投稿が現れる
+	seen := make(map[string]bool, len(list))
+	for _, post := range list {
+		seen[post.Url] = true
+	}
 
-			if post.PostTime.Sub(lastPostTime) <= 0 {
-				skip = true
-				return false
-			}
+	for {
+		doc, n, err := p.fetch(url)
+		attempts += n
+		if err != nil {
+			return nil, attempts, false, fmt.Errorf("%s : %v", url, err)
+		}
 
-			detail := sel.Find("div.detail")
+		pages++
 
-			anchor4 := detail.Find("span a")
-			if p.isExist(anchor4) {
-				post.HasRef = true
-				post.RefUrl, post.RefNo, _ = p.getHrefAndText(anchor4)
-				post.RefNo, _ = p.trimRefNo(post.RefNo)
-			} else {
-				post.HasRef = false
+		posts, skip := p.parseDocument(doc, mark)
+		for _, post := range posts {
+			if seen[post.Url] {
+				continue
 			}
-
-			post.Detail = p.trim(detail.Find("p").Text())
+			seen[post.Url] = true
 
 			list = append(list, post)
-
-			return true
-		})
+		}
 
 		if skip {
-			p.sleepCrawle()
 			break
 		}
 
 		next := doc.Find("a:contains(\"次のページ\")").First()
 
 		if !p.isExist(next) {
-			p.sleepCrawle()
 			break
 		}
 
-		fmt.Println(".")
-		p.sleepCrawle()
-
 		href4, _ := next.Attr("href")
 		url = href4
+
+		// 取得した投稿は保存されるので、途中経過には続きのページだけを残す
+		if maxPages > 0 && pages >= maxPages {
+			log.Printf("%s : stopped at %d pages", key, pages)
+
+			if p.checkpoints != nil {
+				err = p.checkpoints.Save(key, &Checkpoint{Url: start, NextUrl: url})
+				if err != nil {
+					return nil, attempts, false, err
+				}
+			}
+
+			return list, attempts, true, nil
+		}
+
+		fmt.Println(".")
+
+		if p.checkpoints != nil {
+			err = p.checkpoints.Save(key, &Checkpoint{Url: start, NextUrl: url, Posts: list})
+			if err != nil {
+				return nil, attempts, false, err
+			}
+		}
+	}
+
+	return list, attempts, false, nil
+}
+
+// 一時的な失敗はリトライポリシーに従ってリトライする
+func (p *PageParser) fetch(url string) (*goquery.Document, int, error) {
+	attempt := 0
+
+	for {
+		attempt++
+
+		doc, err := p.fetcher.Fetch(url)
+		if err == nil {
+			return doc, attempt, nil
+		}
+
+		if p.retry == nil || attempt >= p.retry.MaxAttempts || !isTemporary(err) {
+			return nil, attempt, err
+		}
+
+		wait := p.retry.backoff(attempt, err)
+		log.Printf("%s : %v (retry %d/%d after %v)", url, err, attempt, p.retry.MaxAttempts-1, wait)
+		time.Sleep(wait)
 	}
+}
+
+// 前回最後に取得した投稿か、それより前の時刻の投稿に達した場合はskipにtrueを返す
+// 投稿日時は分単位なので、前回と同じ分の投稿は取得済みかどうか分からないため取得する
+func (p *PageParser) parseDocument(doc *goquery.Document, mark db.CrawlWatermark) ([]PostDto, bool) {
+	list := make([]PostDto, 0)
+
+	skip := false
+
+	doc.Find("li.commentBox").EachWithBreak(func(_ int, sel *goquery.Selection) bool {
+		post := p.parseComment(sel)
+
+		if (mark.Url != "" && post.Url == mark.Url) || post.PostTime.Before(mark.PostTime) {
+			skip = true
+			return false
+		}
+
+		list = append(list, post)
 
-	return list
+		return true
+	})
+
+	return list, skip
 }
 
-func (p *PageParser) sleepCrawle() {
-	time.Sleep(time.Millisecond * 1100)
+func (p *PageParser) parseComment(sel *goquery.Selection) PostDto {
+	post := PostDto{}
+
+	anchor := sel.Find("div.breadcrumbs ul li a")
+	post.BrandUrl, post.BrandName, _ = p.getHrefAndText(anchor)
+
+	post.CommentNo, _ = p.trimCommentNo(sel.Find("div.commentHeaderInfo div").Text())
+	anchor2 := sel.Find("div.commentHeaderInfo h2 a")
+	post.Url, post.Title, _ = p.getHrefAndText(anchor2)
+
+	uptime := sel.Find("div.ttlInfoDateNum p").Text()
+	// 取得した日時は+09:00 JST
+	post.PostTime, _ = time.ParseInLocation("2006/01/02 15:04", uptime, util.SiteLocation)
+
+	detail := sel.Find("div.detail")
+
+	anchor4 := detail.Find("span a")
+	if p.isExist(anchor4) {
+		post.HasRef = true
+		post.RefUrl, post.RefNo, _ = p.getHrefAndText(anchor4)
+		post.RefNo, _ = p.trimRefNo(post.RefNo)
+	} else {
+		post.HasRef = false
+	}
+
+	post.Detail = p.trim(detail.Find("p").Text())
+
+	writer := sel.Find("div.commentHeaderInfo p.comWriter a")
+	if p.isExist(writer) {
+		post.AuthorUrl, post.AuthorName, _ = p.getHrefAndText(writer)
+		post.AuthorId, _ = p.getYahooId(post.AuthorUrl)
+	}
+
+	return post
 }
 
 func (p *PageParser) trim(s string) string {
@@ -254,6 +663,21 @@ func (p *PageParser) trimCommentNo(s string) (string, error) {
 	return str[3:], nil
 }
 
+// ユーザーページのURLのuserパラメータがYahoo ID
+func (p *PageParser) getYahooId(href string) (string, error) {
+	u, err := neturl.Parse(href)
+	if err != nil {
+		return "", err
+	}
+
+	id := u.Query().Get("user")
+	if id == "" {
+		return "", fmt.Errorf("not user url : %s", href)
+	}
+
+	return id, nil
+}
+
 func (p *PageParser) trimRefNo(s string) (string, error) {
 	i := strings.Index(s, " ")
 	if i > -1 {
@@ -263,60 +687,39 @@ func (p *PageParser) trimRefNo(s string) (string, error) {
 	}
 }
 
+// os.Exitではdeferが実行されないので、ここでDBを閉じる
 func exit(err error) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 	}
 
+	db.Close()
 	os.Exit(1)
 }
 
 type MyLogic struct {
 	tc *db.TxContainer
+	// 有効な監視条件。最初に使う時に読み込む
+	matchers []*watch.Matcher
 }
 
 func NewMyLogic(tc *db.TxContainer) *MyLogic {
 	return &MyLogic{tc: tc}
 }
 
-func (m *MyLogic) getLastPostTime(userId int) (time.Time, bool, error) {
-	var v interface{}
-
-	err := m.tc.Tx.SelectOne(&v, "select max(post_time) as last_post_time from post where user_id = ?", userId)
-	if err != nil {
-		return time.Now(), false, err
-	}
-
-	if v == nil {
-		return time.Date(1900, 1, 1, 0, 0, 0, 0, time.Local), false, nil
-	} else {
-		switch t := v.(type) {
-		case []byte:
-			//fmt.Println(t, string(t))
-			// SQLiteに保存した日時はUTCになるので、UTCで取得後+09:00JSTに変換
-			s, err := time.ParseInLocation("2006-01-02 15:04:05", string(t), time.UTC)
-			if err != nil {
-				exit(err)
-			}
+// 同じURLの投稿が保存済みの場合は内容を更新し、新規投稿として通知しない
+// 新規投稿は監視条件と照合し、該当した条件ごとにアラートを作成する
+// 戻り値は新規に保存した投稿のID
+func (m *MyLogic) savePosts(userId int, posts []PostDto) ([]int, error) {
+	added := make([]int, 0, len(posts))
 
-			s = s.In(time.Local)
+	brands := db.NewBrandRepo(m.tc)
+	notifications := db.NewNotificationRepo(m.tc)
 
-			return s, true, nil
-		case time.Time:
-			return t, true, nil
-		default:
-			exit(fmt.Errorf("%v を time.Timeに変換できません。", v))
-			return time.Now(), false, nil
-		}
-	}
-}
-
-func (m *MyLogic) savePosts(userId int, posts []PostDto) error {
 	for _, post := range posts {
-		// 2回コネクションを取得することになる
-		brand, err := m.getBrandByName(post.BrandName)
+		brand, err := brands.GetByName(post.BrandName)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		if brand == nil {
@@ -325,15 +728,14 @@ func (m *MyLogic) savePosts(userId int, posts []PostDto) error {
 				Url:       post.BrandUrl,
 			}
 
-			// TODO:
-			brand, err = m.addBrand(brand)
+			err = brands.Add(brand)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
-			err = m.addBrandNotification(&db.BrandNotification{BrandId: brand.Id, PostTime: time.Now()})
+			err = notifications.AddBrand(&db.BrandNotification{BrandId: brand.Id, PostTime: time.Now()})
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 
@@ -352,138 +754,210 @@ func (m *MyLogic) savePosts(userId int, posts []PostDto) error {
 			_ = et.RefUrl.Scan(post.RefUrl)
 		}
 
-		err = m.tc.Tx.Insert(&et)
+		isNew, err := db.NewPostRepo(m.tc).Save(&et)
 		if err != nil {
-			m.tc.Err = err
-			log.Println(err)
-			return err
+			return nil, err
 		}
 
-		err = m.addPostNotification(&db.PostNotification{PostId: et.Id})
+		if !isNew {
+			continue
+		}
+
+		err = notifications.AddPost(&db.PostNotification{PostId: et.Id})
 		if err != nil {
-			m.tc.Err = err
-			log.Println(err)
-			return err
+			return nil, err
 		}
+
+		err = m.addAlerts(&et)
+		if err != nil {
+			return nil, err
+		}
+
+		added = append(added, et.Id)
 	}
 
-	return nil
+	return added, nil
 }
 
-func (m *MyLogic) addBrand(brand *db.Brand) (*db.Brand, error) {
-	err := m.tc.Tx.Insert(brand)
+// 不正な監視条件はログに出力して無視する
+func (m *MyLogic) getMatchers() ([]*watch.Matcher, error) {
+	if m.matchers != nil {
+		return m.matchers, nil
+	}
+
+	rules, err := db.NewWatchRuleRepo(m.tc).ListEnabled()
 	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
 		return nil, err
 	}
 
-	return brand, nil
-}
+	m.matchers = make([]*watch.Matcher, 0, len(rules))
+	for _, rule := range rules {
+		matcher, err := watch.Compile(rule)
+		if err != nil {
+			log.Printf("watch rule %d : %v", rule.Id, err)
+			continue
+		}
 
-func (m *MyLogic) addBrandNotification(bn *db.BrandNotification) error {
-	err := m.tc.Tx.Insert(bn)
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return err
+		m.matchers = append(m.matchers, matcher)
 	}
 
-	return nil
+	return m.matchers, nil
 }
 
-func (m *MyLogic) addPostNotification(pn *db.PostNotification) error {
-	err := m.tc.Tx.Insert(pn)
+func (m *MyLogic) addAlerts(post *db.Post) error {
+	matchers, err := m.getMatchers()
 	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
 		return err
 	}
 
+	alerts := db.NewAlertRepo(m.tc)
+
+	for _, matcher := range matchers {
+		if !matcher.Match(post) {
+			continue
+		}
+
+		fmt.Printf("アラート : %s (%s)\n", matcher.Rule.Name, post.Url)
+
+		err = alerts.Add(&db.Alert{WatchRuleId: matcher.Rule.Id, PostId: post.Id, CreatedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (m *MyLogic) getBrandByName(brandName string) (*db.Brand, error) {
-	if brandName == "" {
-		exit(errors.New("brand name is empty"))
+// 最後のページか前回の取得位置まで取得した場合は途中経過を削除する
+// (ページ数で打ち切った場合は、次回その続きから取得するために残す)
+// 掲示板の投稿は投稿者ごとに保存し、未登録の投稿者はユーザーとして追加する
+func (m *MyLogic) saveResult(result *PageResult) ([]int, error) {
+	crawls := db.NewCrawlRepo(m.tc)
+
+	if !result.Truncated {
+		err := crawls.DeleteState(result.Job.Key())
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	var b db.Brand
-	err := m.tc.Tx.SelectOne(&b, "select * from brand where brand_name=?", brandName)
-	if err == sql.ErrNoRows {
+	if len(result.Posts) == 0 {
 		return nil, nil
-	} else if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return nil, err
 	}
 
-	return &b, nil
-}
+	latest := latestPost(result.Posts)
 
-func (m *MyLogic) addUsersIfNotExist(users []UserJson) error {
-	for _, user := range users {
-		var u db.User
+	if result.Job.Brand == nil {
+		userId := result.Job.User.Id
 
-		err := m.tc.Tx.SelectOne(&u, "select * from user where yahoo_id=?", user.YahooId)
-		if err == sql.ErrNoRows {
-			u = db.User{
-				YahooId: user.YahooId,
-				Url:     user.Url,
-			}
+		added, err := m.savePosts(userId, result.Posts)
+		if err != nil {
+			return nil, err
+		}
 
-			if user.DisplayName != "" {
-				u.DisplayName.Scan(user.DisplayName)
-			}
+		// -backfillで続きのページから取得した場合は、取得位置を古い投稿に戻さない
+		if latest.PostTime.Before(result.Job.Watermark.PostTime) {
+			return added, nil
+		}
 
-			err = m.tc.Tx.Insert(&u)
-			if err != nil {
-				m.tc.Err = err
-				return err
-			}
-		} else if err != nil {
-			m.tc.Err = err
-			log.Println(err)
-			return err
+		err = crawls.SaveWatermark(&db.CrawlWatermark{
+			UserId:    userId,
+			Url:       latest.Url,
+			CommentNo: latest.CommentNo,
+			PostTime:  latest.PostTime,
+		})
+
+		return added, err
+	}
+
+	added := make([]int, 0, len(result.Posts))
+
+	for _, post := range result.Posts {
+		user, err := m.addAuthorIfNotExist(post)
+		if err != nil {
+			return nil, err
 		}
+
+		ids, err := m.savePosts(user.Id, []PostDto{post})
+		if err != nil {
+			return nil, err
+		}
+
+		added = append(added, ids...)
 	}
 
-	return nil
-}
+	err := crawls.SaveBoardWatermark(&db.BoardWatermark{
+		BrandId:   result.Job.Brand.Id,
+		Url:       latest.Url,
+		CommentNo: latest.CommentNo,
+		PostTime:  latest.PostTime,
+	})
 
-// func (m *MyLogic) getUsers() ([]db.User, error) {
-// 	var users []db.User
-// 	_, err := m.tc.Tx.Select(&users, "select * from user order by id")
-// 	if err != nil {
-// 		m.tc.Err = err
-// 		log.Println(err)
-// 		return nil, err
-// 	}
+	return added, err
+}
 
-// 	return users, nil
-// }
-func (m *MyLogic) getUsers() ([]db.UserPostTimeView, error) {
-	var users []db.UserPostTimeView
-	_, err := m.tc.Tx.Select(
-		&users,
-		"select A.id as Id, A.yahoo_id as YahooId, A.display_name as DisplayName, A.url as Url, B.post_time as PostTimeString from user A left join (select user_id, max(post_time) as post_time from post A1 group by user_id) B on A.id = B.user_id order by A.id asc")
-	if err != nil {
+func (m *MyLogic) addAuthorIfNotExist(post PostDto) (*db.User, error) {
+	if post.AuthorId == "" {
+		err := fmt.Errorf("author not found : %s", post.Url)
 		m.tc.Err = err
-		log.Println(err)
 		return nil, err
 	}
 
-	for i, _ := range users {
-		if users[i].PostTimeString.Valid && users[i].PostTimeString.String != "" {
-			//if users[i].PostTimeString != "" {
-			t, err := time.ParseInLocation("2006-01-02 15:04:05", users[i].PostTimeString.String, time.UTC)
-			if err != nil {
-				return nil, err
-			} else {
-				users[i].PostTime = t
-			}
+	u := &db.User{
+		YahooId: post.AuthorId,
+		Url:     post.AuthorUrl,
+	}
+
+	if post.AuthorName != "" {
+		u.DisplayName.Scan(post.AuthorName)
+	}
+
+	return db.NewUserRepo(m.tc).AddIfNotExist(u)
+}
+
+// importUsers は登録済みのユーザーのURLと表示名を更新して取得対象にし、未登録のユーザーは追加する
+// 戻り値は追加した件数と更新した件数
+func (m *MyLogic) importUsers(users []UserJson) (int, int, error) {
+	repo := db.NewUserRepo(m.tc)
+
+	added, updated := 0, 0
+
+	for _, user := range users {
+		// 画面で登録できないユーザーは登録しない
+		if msg := util.ValidateUser(user.YahooId, user.DisplayName, user.Url); msg != "" {
+			err := fmt.Errorf("invalid user %+v : %s", user, msg)
+			m.tc.Err = err
+			return 0, 0, err
+		}
+
+		u, err := repo.GetByYahooId(user.YahooId)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if u == nil {
+			u = &db.User{YahooId: user.YahooId}
+		}
+
+		u.Url = user.Url
+		u.Active = true
+
+		if user.DisplayName != "" {
+			u.DisplayName.Scan(user.DisplayName)
+		}
+
+		if u.Id == 0 {
+			err = repo.Add(u)
+			added++
+		} else {
+			err = repo.Update(u)
+			updated++
+		}
+
+		if err != nil {
+			return 0, 0, err
 		}
 	}
 
-	return users, nil
+	return added, updated, nil
 }
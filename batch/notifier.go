@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"../db"
+	"../util"
+)
+
+// Notification は1件の取得対象(ユーザーか掲示板)で新規に保存した投稿
+type Notification struct {
+	Source string         `json:"source"`
+	Posts  []NotifiedPost `json:"posts"`
+}
+
+type NotifiedPost struct {
+	Id        int       `json:"id"`
+	YahooId   string    `json:"yahoo_id"`
+	UserName  string    `json:"user_name"`
+	BrandName string    `json:"brand_name"`
+	BrandUrl  string    `json:"brand_url"`
+	CommentNo string    `json:"comment_no"`
+	Title     string    `json:"title"`
+	Url       string    `json:"url"`
+	Detail    string    `json:"detail"`
+	PostTime  time.Time `json:"post_time"`
+}
+
+func NewNotification(source string, ps []db.PostView) *Notification {
+	n := &Notification{Source: source, Posts: make([]NotifiedPost, len(ps))}
+
+	for i, p := range ps {
+		name := p.UserYahooId
+		if p.UserDisplayName.Valid {
+			name = p.UserDisplayName.String
+		}
+
+		n.Posts[i] = NotifiedPost{
+			Id:        p.Id,
+			YahooId:   p.UserYahooId,
+			UserName:  name,
+			BrandName: p.BrandName,
+			BrandUrl:  p.BrandUrl,
+			CommentNo: p.CommentNo,
+			Title:     p.Title,
+			Url:       p.Url,
+			Detail:    p.Detail,
+			PostTime:  p.PostTime.In(util.DisplayLocation),
+		}
+	}
+
+	return n
+}
+
+// Channel は通知の送信先
+type Channel interface {
+	Name() string
+	Send(n *Notification) error
+}
+
+// DeliveryLog は通知の送信結果を記録する
+type DeliveryLog interface {
+	Record(d *db.NotificationDelivery) error
+}
+
+// Notifier は新規投稿を設定された全ての送信先に送る
+// Enqueueした通知は1つのgoroutineで順に送るので、送信のリトライで取得や保存が止まらない
+type Notifier struct {
+	channels   []Channel
+	retry      *RetryPolicy
+	deliveries DeliveryLog
+	queue      chan *Notification
+	done       chan struct{}
+	// closedはqueueへの送信と同じmuで守る
+	mu     sync.Mutex
+	closed bool
+}
+
+// deliveriesがnilの場合は送信結果を記録しない
+// 使い終わったらCloseを呼ぶこと
+func NewNotifier(c util.NotifierConfig, deliveries DeliveryLog) (*Notifier, error) {
+	timeout := time.Duration(c.TimeoutMsec) * time.Millisecond
+	client := &http.Client{Timeout: timeout}
+
+	n := &Notifier{retry: NewRetryPolicy(c.Retry), deliveries: deliveries}
+
+	for _, cc := range c.Channels {
+		var ch Channel
+		var err error
+
+		switch cc.Type {
+		case "webhook":
+			ch, err = NewWebhookChannel(cc, client)
+		case "slack":
+			ch, err = NewSlackChannel(cc, client)
+		case "smtp":
+			ch, err = NewSmtpChannel(cc, timeout)
+		default:
+			err = fmt.Errorf("unknown channel type : %s", cc.Type)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		n.channels = append(n.channels, ch)
+	}
+
+	size := c.QueueSize
+	if size < 1 {
+		size = 1
+	}
+
+	n.queue = make(chan *Notification, size)
+	n.done = make(chan struct{})
+
+	go n.run()
+
+	return n, nil
+}
+
+// 送信先ごとのエラーはNotifyでログに出力している
+func (n *Notifier) run() {
+	defer close(n.done)
+
+	for notification := range n.queue {
+		n.Notify(notification)
+	}
+}
+
+// Enqueue は通知を送信待ちに追加して、送信を待たずに戻る
+// 送信待ちが設定の件数に達している場合とClose後は追加せずにfalseを返し、
+// 送らなかったことを送信先ごとに失敗として記録する(取得位置は進んでいるので再送はされない)
+func (n *Notifier) Enqueue(notification *Notification) bool {
+	err := n.enqueue(notification)
+	if err == nil {
+		return true
+	}
+
+	log.Printf("notify %s : %v", notification.Source, err)
+
+	for _, ch := range n.channels {
+		n.record(ch, notification, 0, err)
+	}
+
+	return false
+}
+
+func (n *Notifier) enqueue(notification *Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return errors.New("notifier is closed")
+	}
+
+	select {
+	case n.queue <- notification:
+		return nil
+	default:
+		return errors.New("queue is full")
+	}
+}
+
+// Close は送信待ちの通知を全て送り終わるまで待つ
+// Closeの後のEnqueueは送信せずにfalseを返す。2回目以降のCloseは何もしない
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+
+	n.closed = true
+	close(n.queue)
+	n.mu.Unlock()
+
+	<-n.done
+}
+
+// Notify は送信先ごとにリトライしながら送り、投稿ごとの送信結果を記録する
+// 送信に失敗した送信先があっても他の送信先には送る
+func (n *Notifier) Notify(notification *Notification) error {
+	if len(notification.Posts) == 0 {
+		return nil
+	}
+
+	failed := 0
+
+	for _, ch := range n.channels {
+		attempts, err := n.send(ch, notification)
+
+		if err != nil {
+			log.Printf("notify %s : %v", ch.Name(), err)
+			failed++
+		}
+
+		n.record(ch, notification, attempts, err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d件の送信先への通知に失敗しました", failed)
+	}
+
+	return nil
+}
+
+// record は投稿ごとの送信結果を記録する。errがnilでない場合は失敗として記録する
+func (n *Notifier) record(ch Channel, notification *Notification, attempts int, err error) {
+	if n.deliveries == nil {
+		return
+	}
+
+	status := db.DeliverySent
+	if err != nil {
+		status = db.DeliveryFailed
+	}
+
+	for _, p := range notification.Posts {
+		d := &db.NotificationDelivery{
+			Channel:     ch.Name(),
+			PostId:      p.Id,
+			Status:      status,
+			Attempts:    attempts,
+			DeliveredAt: time.Now(),
+		}
+
+		if err != nil {
+			d.Error.Scan(err.Error())
+		}
+
+		if err := n.deliveries.Record(d); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// 2つ目の戻り値はリトライを含めた送信回数
+func (n *Notifier) send(ch Channel, notification *Notification) (int, error) {
+	attempt := 0
+
+	for {
+		attempt++
+
+		err := ch.Send(notification)
+		if err == nil {
+			return attempt, nil
+		}
+
+		if attempt >= n.retry.MaxAttempts || !isTemporaryDelivery(err) {
+			return attempt, err
+		}
+
+		wait := n.retry.backoff(attempt, err)
+		log.Printf("notify %s : %v (retry %d/%d after %v)", ch.Name(), err, attempt, n.retry.MaxAttempts-1, wait)
+		time.Sleep(wait)
+	}
+}
+
+// SMTPの4xxは一時的なエラー
+func isTemporaryDelivery(err error) bool {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return te.Code >= 400 && te.Code < 500
+	}
+
+	return isTemporary(err)
+}
+
+// DbDeliveryLog はnotification_deliveryテーブルに送信結果を記録する
+type DbDeliveryLog struct {
+}
+
+func NewDbDeliveryLog() *DbDeliveryLog {
+	return &DbDeliveryLog{}
+}
+
+func (l *DbDeliveryLog) Record(d *db.NotificationDelivery) error {
+	return db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		return db.NewNotificationRepo(tc).AddDelivery(d)
+	})
+}
+
+var notifyFuncs = template.FuncMap{
+	"formatTime": func(t time.Time) string {
+		return t.In(util.DisplayLocation).Format("2006-01-02 15:04")
+	},
+	// Slackのメッセージでは&、<、>をエスケープする
+	"slackEscape": strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace,
+}
+
+func parseTemplate(name string, text string, def string) (*template.Template, error) {
+	if text == "" {
+		text = def
+	}
+
+	return template.New(name).Funcs(notifyFuncs).Parse(text)
+}
+
+func executeTemplate(t *template.Template, n *Notification) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, n); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func channelName(cc util.ChannelConfig) string {
+	if cc.Name != "" {
+		return cc.Name
+	}
+
+	return cc.Type
+}
+
+// 2xx以外はHttpErrorを返す
+func postJson(client *http.Client, url string, body []byte) error {
+	res, err := client.Post(url, "application/json; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return &HttpError{
+			StatusCode: res.StatusCode,
+			RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	return nil
+}
+
+// WebhookChannel はNotificationをJSONでPOSTする
+// templateを指定した場合は、その結果をそのまま本文にする
+type WebhookChannel struct {
+	name   string
+	url    string
+	tmpl   *template.Template
+	client *http.Client
+}
+
+func NewWebhookChannel(cc util.ChannelConfig, client *http.Client) (*WebhookChannel, error) {
+	ch := &WebhookChannel{name: channelName(cc), url: cc.Url, client: client}
+
+	if !util.IsHttpUrl(cc.Url) {
+		return nil, fmt.Errorf("%s : url is not http(s) : %q", ch.name, cc.Url)
+	}
+
+	if cc.Template != "" {
+		t, err := parseTemplate(ch.name, cc.Template, "")
+		if err != nil {
+			return nil, err
+		}
+
+		ch.tmpl = t
+	}
+
+	return ch, nil
+}
+
+func (c *WebhookChannel) Name() string {
+	return c.name
+}
+
+func (c *WebhookChannel) Send(n *Notification) error {
+	var body []byte
+	var err error
+
+	if c.tmpl == nil {
+		body, err = json.Marshal(n)
+	} else {
+		var s string
+		s, err = executeTemplate(c.tmpl, n)
+		body = []byte(s)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return postJson(c.client, c.url, body)
+}
+
+const defaultSlackTemplate = `{{slackEscape .Source}} の新規投稿 {{len .Posts}}件
+{{range .Posts}}
+<{{.Url}}|[{{slackEscape .BrandName}}] {{slackEscape .Title}}> {{formatTime .PostTime}}
+{{slackEscape .Detail}}
+{{end}}`
+
+// SlackChannel はSlack互換のIncoming Webhookにtemplateの結果をtextとして送る
+type SlackChannel struct {
+	name   string
+	url    string
+	tmpl   *template.Template
+	client *http.Client
+}
+
+func NewSlackChannel(cc util.ChannelConfig, client *http.Client) (*SlackChannel, error) {
+	ch := &SlackChannel{name: channelName(cc), url: cc.Url, client: client}
+
+	if !util.IsHttpUrl(cc.Url) {
+		return nil, fmt.Errorf("%s : url is not http(s) : %q", ch.name, cc.Url)
+	}
+
+	t, err := parseTemplate(ch.name, cc.Template, defaultSlackTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	ch.tmpl = t
+
+	return ch, nil
+}
+
+func (c *SlackChannel) Name() string {
+	return c.name
+}
+
+func (c *SlackChannel) Send(n *Notification) error {
+	text, err := executeTemplate(c.tmpl, n)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	return postJson(c.client, c.url, body)
+}
+
+const (
+	defaultMailSubject  = `{{.Source}} の新規投稿 {{len .Posts}}件`
+	defaultMailTemplate = `{{.Source}} の新規投稿 {{len .Posts}}件
+{{range .Posts}}
+[{{.BrandName}}] {{.Title}}
+{{.Url}}
+{{formatTime .PostTime}}
+{{.Detail}}
+{{end}}`
+)
+
+// SmtpChannel はtemplateの結果を本文にしたメールを送る
+type SmtpChannel struct {
+	name    string
+	cfg     util.SmtpConfig
+	subject *template.Template
+	body    *template.Template
+	timeout time.Duration
+}
+
+func NewSmtpChannel(cc util.ChannelConfig, timeout time.Duration) (*SmtpChannel, error) {
+	ch := &SmtpChannel{name: channelName(cc), cfg: cc.Smtp, timeout: timeout}
+
+	if len(ch.cfg.To) == 0 {
+		return nil, fmt.Errorf("%s : smtp.to is empty", ch.name)
+	}
+
+	var err error
+
+	ch.subject, err = parseTemplate(ch.name+"_subject", cc.Smtp.Subject, defaultMailSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	ch.body, err = parseTemplate(ch.name, cc.Template, defaultMailTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+func (c *SmtpChannel) Name() string {
+	return c.name
+}
+
+func (c *SmtpChannel) Send(n *Notification) error {
+	subject, err := executeTemplate(c.subject, n)
+	if err != nil {
+		return err
+	}
+
+	body, err := executeTemplate(c.body, n)
+	if err != nil {
+		return err
+	}
+
+	return c.sendMail(c.message(strings.TrimSpace(subject), body, time.Now()))
+}
+
+// 件名はMIMEエンコードし、本文はbase64にする
+func (c *SmtpChannel) message(subject string, body string, now time.Time) []byte {
+	var buf bytes.Buffer
+
+	header := [][2]string{
+		{"From", c.cfg.From},
+		{"To", strings.Join(c.cfg.To, ", ")},
+		{"Subject", mime.BEncoding.Encode("UTF-8", subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=UTF-8"},
+		{"Content-Transfer-Encoding", "base64"},
+	}
+
+	for _, h := range header {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+
+	buf.WriteString("\r\n")
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(body))
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+
+	return buf.Bytes()
+}
+
+// smtp.SendMailにはタイムアウトがないので、接続にタイムアウトを設定して同じ手順で送る
+func (c *SmtpChannel) sendMail(msg []byte) error {
+	addr := net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port))
+
+	conn, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return err
+	}
+
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	client, err := smtp.NewClient(conn, c.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: c.cfg.Host}); err != nil {
+			return err
+		}
+	}
+
+	if c.cfg.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+
+		if err = client.Auth(smtp.PlainAuth("", c.cfg.Username, c.cfg.Password, c.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(c.cfg.From); err != nil {
+		return err
+	}
+
+	for _, to := range c.cfg.To {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"../db"
+	"../util"
+)
+
+type memoryDeliveryLog struct {
+	mu         sync.Mutex
+	deliveries []db.NotificationDelivery
+}
+
+func (l *memoryDeliveryLog) Record(d *db.NotificationDelivery) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.deliveries = append(l.deliveries, *d)
+
+	return nil
+}
+
+// テストではリトライの間隔を空けない
+func testNotifierConfig(channels ...util.ChannelConfig) util.NotifierConfig {
+	return util.NotifierConfig{
+		TimeoutMsec: 5000,
+		Retry:       util.RetryConfig{MaxAttempts: 3, Multiplier: 2},
+		Channels:    channels,
+	}
+}
+
+func testNotification() *Notification {
+	return &Notification{
+		Source: "testuser",
+		Posts: []NotifiedPost{
+			{
+				Id:        1,
+				YahooId:   "testuser",
+				UserName:  "テストユーザー",
+				BrandName: "(株)ＳＵＭＣＯ",
+				CommentNo: "12345",
+				Title:     "決算 & <予想>",
+				Url:       "http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6/12345",
+				Detail:    "明日はストップ高",
+				PostTime:  time.Date(2014, 5, 20, 15, 4, 0, 0, util.SiteLocation),
+			},
+			{Id: 2, Title: "2件目", Url: "http://example.com/2"},
+		},
+	}
+}
+
+func TestWebhookChannel(t *testing.T) {
+	var requests int
+	var body []byte
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if ct := r.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	l := &memoryDeliveryLog{}
+	n, err := NewNotifier(testNotifierConfig(util.ChannelConfig{Type: "webhook", Url: ts.URL}), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = n.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Notification
+	if err = json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("%v : %s", err, body)
+	}
+
+	if got.Source != "testuser" || len(got.Posts) != 2 || got.Posts[0].Title != "決算 & <予想>" {
+		t.Errorf("body = %s", body)
+	}
+
+	// 503の後にリトライして送信できた
+	if len(l.deliveries) != 2 {
+		t.Fatalf("deliveries = %d, want 2", len(l.deliveries))
+	}
+
+	for i, d := range l.deliveries {
+		if d.Channel != "webhook" || d.PostId != i+1 || d.Status != db.DeliverySent || d.Attempts != 2 || d.Error.Valid {
+			t.Errorf("delivery = %+v", d)
+		}
+	}
+}
+
+func TestWebhookChannelPermanentError(t *testing.T) {
+	var requests int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	l := &memoryDeliveryLog{}
+	n, err := NewNotifier(testNotifierConfig(util.ChannelConfig{Name: "hook", Type: "webhook", Url: ts.URL}), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = n.Notify(testNotification()); err == nil {
+		t.Fatal("Notify() should fail")
+	}
+
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+
+	d := l.deliveries[0]
+	if d.Channel != "hook" || d.Status != db.DeliveryFailed || d.Attempts != 1 || d.Error.String != "400 Bad Request" {
+		t.Errorf("delivery = %+v", d)
+	}
+}
+
+func TestWebhookChannelTemplate(t *testing.T) {
+	var body string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer ts.Close()
+
+	cc := util.ChannelConfig{
+		Type:     "webhook",
+		Url:      ts.URL,
+		Template: `{"count":{{len .Posts}},"first":"{{(index .Posts 0).CommentNo}}"}`,
+	}
+
+	n, err := NewNotifier(testNotifierConfig(cc), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = n.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{"count":2,"first":"12345"}`; body != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+}
+
+func TestSlackChannel(t *testing.T) {
+	var payload map[string]string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+	}))
+	defer ts.Close()
+
+	n, err := NewNotifier(testNotifierConfig(util.ChannelConfig{Type: "slack", Url: ts.URL}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = n.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+
+	text := payload["text"]
+	for _, want := range []string{
+		"testuser の新規投稿 2件",
+		"<http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6/12345|[(株)ＳＵＭＣＯ] 決算 &amp; &lt;予想&gt;> 2014-05-20 15:04",
+		"明日はストップ高",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text does not contain %q\n%s", want, text)
+		}
+	}
+}
+
+// smtpServer は1通だけ受信するSMTPサーバー
+// mailCodeが0でない場合はMAILコマンドにそのコードを返す
+type smtpServer struct {
+	ln       net.Listener
+	mailCode int
+	data     chan string
+}
+
+func newSmtpServer(t *testing.T, mailCode int) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &smtpServer{ln: ln, mailCode: mailCode, data: make(chan string, 1)}
+	go s.serve()
+
+	return s
+}
+
+func (s *smtpServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL"):
+			if s.mailCode != 0 {
+				reply(strconv.Itoa(s.mailCode) + " try again later")
+				continue
+			}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT"), strings.HasPrefix(cmd, "RSET"), strings.HasPrefix(cmd, "NOOP"):
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+
+			var data []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+
+				if l == ".\r\n" {
+					break
+				}
+
+				data = append(data, strings.TrimPrefix(l, "."))
+			}
+
+			s.data <- strings.Join(data, "")
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestSmtpChannel(t *testing.T) {
+	s := newSmtpServer(t, 0)
+	defer s.ln.Close()
+
+	cc := util.ChannelConfig{
+		Name: "mail",
+		Type: "smtp",
+		Smtp: util.SmtpConfig{
+			Host:    "127.0.0.1",
+			Port:    s.port(),
+			From:    "batch@example.com",
+			To:      []string{"a@example.com", "b@example.com"},
+			Subject: "[textream] {{.Source}} {{len .Posts}}件",
+		},
+	}
+
+	l := &memoryDeliveryLog{}
+	n, err := NewNotifier(testNotifierConfig(cc), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = n.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(<-s.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "[textream] testuser 2件" {
+		t.Errorf("Subject = %q, %v", subject, err)
+	}
+
+	if to := msg.Header.Get("To"); to != "a@example.com, b@example.com" {
+		t.Errorf("To = %q", to)
+	}
+
+	b, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, msg.Body))
+	body := string(b)
+	for _, want := range []string{"[(株)ＳＵＭＣＯ] 決算 & <予想>", "2014-05-20 15:04", "明日はストップ高"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %q\n%s", want, body)
+		}
+	}
+
+	if len(l.deliveries) != 2 || l.deliveries[0].Status != db.DeliverySent {
+		t.Errorf("deliveries = %+v", l.deliveries)
+	}
+}
+
+func TestSmtpChannelTemporaryError(t *testing.T) {
+	s := newSmtpServer(t, 451)
+	defer s.ln.Close()
+
+	cc := util.ChannelConfig{
+		Type: "smtp",
+		Smtp: util.SmtpConfig{Host: "127.0.0.1", Port: s.port(), From: "batch@example.com", To: []string{"a@example.com"}},
+	}
+
+	l := &memoryDeliveryLog{}
+	n, err := NewNotifier(testNotifierConfig(cc), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = n.Notify(testNotification()); err == nil {
+		t.Fatal("Notify() should fail")
+	}
+
+	// 4xxはリトライする
+	d := l.deliveries[0]
+	if d.Status != db.DeliveryFailed || d.Attempts != 3 || !strings.Contains(d.Error.String, "451") {
+		t.Errorf("delivery = %+v", d)
+	}
+}
+
+func TestNewNotifierError(t *testing.T) {
+	tests := []util.ChannelConfig{
+		{Type: "unknown"},
+		{Type: "slack", Url: "http://example.com/slack", Template: "{{.Source"},
+		{Type: "smtp"},
+		{Type: "webhook"},
+		{Type: "webhook", Url: "example.com/hook"},
+		{Type: "slack", Url: "ftp://example.com/slack"},
+	}
+
+	for _, cc := range tests {
+		if _, err := NewNotifier(testNotifierConfig(cc), nil); err == nil {
+			t.Errorf("NewNotifier(%+v) should fail", cc)
+		}
+	}
+}
+
+// 送信中でもEnqueueはすぐに戻り、送信待ちがいっぱいの場合は追加しない
+func TestNotifierEnqueue(t *testing.T) {
+	received := make(chan struct{}, 3)
+	release := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer ts.Close()
+
+	cfg := testNotifierConfig(util.ChannelConfig{Type: "webhook", Url: ts.URL})
+	cfg.QueueSize = 1
+
+	l := &memoryDeliveryLog{}
+	n, err := NewNotifier(cfg, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !n.Enqueue(testNotification()) {
+		t.Fatal("1st Enqueue() = false")
+	}
+
+	// 1件目の送信中に2件目は送信待ちになり、3件目は追加できない
+	<-received
+
+	if !n.Enqueue(testNotification()) {
+		t.Error("2nd Enqueue() = false")
+	}
+
+	if n.Enqueue(testNotification()) {
+		t.Error("3rd Enqueue() = true, want false")
+	}
+
+	close(release)
+	n.Close()
+
+	if len(received) != 1 {
+		t.Errorf("requests after the 1st = %d, want 1", len(received))
+	}
+
+	// Close後のEnqueueはpanicせずに追加できない
+	if n.Enqueue(testNotification()) {
+		t.Error("Enqueue() after Close = true, want false")
+	}
+
+	n.Close()
+
+	// Closeは送信待ちの通知を送り終わってから戻る
+	// 追加できなかった通知も投稿ごとに失敗として記録する
+	statuses := map[string]int{}
+	for _, d := range l.deliveries {
+		statuses[d.Status]++
+
+		if d.Status == db.DeliveryFailed && (d.Attempts != 0 || !d.Error.Valid) {
+			t.Errorf("delivery = %+v", d)
+		}
+	}
+
+	if statuses[db.DeliverySent] != 4 || statuses[db.DeliveryFailed] != 4 {
+		t.Errorf("deliveries = %v, want 4 sent, 4 failed", statuses)
+	}
+}
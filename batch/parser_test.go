@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+
+	"../db"
+	"../util"
+)
+
+// go test -run Golden -update でゴールデンファイルを再生成する
+var update = flag.Bool("update", false, "update golden files")
+
+func TestParseDocumentGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/parse/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) == 0 {
+		t.Fatal("no fixtures in testdata/parse")
+	}
+
+	p := NewPageParser(nil, nil, nil)
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		doc, err := goquery.NewDocumentFromReader(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		posts, skip := p.parseDocument(doc, db.CrawlWatermark{})
+		if skip {
+			t.Errorf("%s: skip = true, want false", file)
+		}
+
+		checkGolden(t, strings.TrimSuffix(file, ".html")+".golden.json", posts)
+	}
+}
+
+func TestGetPageGolden(t *testing.T) {
+	p := NewPageParser(NewFileFetcher("testdata/crawl"), nil, nil)
+
+	mark := db.CrawlWatermark{
+		Url:       "http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6/12345",
+		CommentNo: "12345",
+		PostTime:  time.Date(2014, 5, 20, 15, 4, 0, 0, util.SiteLocation),
+	}
+	posts, _, _, err := p.getPage("", "http://textream.yahoo.co.jp/personal/history/comment?user=testuser", mark, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGolden(t, "testdata/crawl.golden.json", posts)
+}
+
+func TestGetBoardPageGolden(t *testing.T) {
+	p := NewPageParser(NewFileFetcher("testdata/crawl"), nil, nil)
+
+	mark := db.CrawlWatermark{
+		Url:       "http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6/12350",
+		CommentNo: "12350",
+		PostTime:  time.Date(2014, 5, 21, 10, 30, 0, 0, util.SiteLocation),
+	}
+	posts, _, _, err := p.getPage("", "http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6", mark, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGolden(t, "testdata/board.golden.json", posts)
+}
+
+func TestGetPageWithoutWatermarkUrl(t *testing.T) {
+	p := NewPageParser(NewFileFetcher("testdata/crawl"), nil, nil)
+
+	// URLが分からない場合は、同じ分の投稿を全て取得してそれより前の投稿で停止する
+	mark := db.CrawlWatermark{PostTime: time.Date(2014, 5, 20, 15, 4, 0, 0, util.SiteLocation)}
+	posts, _, _, err := p.getPage("", "http://textream.yahoo.co.jp/personal/history/comment?user=testuser", mark, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nos := make([]string, len(posts))
+	for i, post := range posts {
+		nos[i] = post.CommentNo
+	}
+
+	if got, want := strings.Join(nos, ","), "12350,880,54400,54399,12345"; got != want {
+		t.Errorf("comment nos = %s, want %s", got, want)
+	}
+}
+
+func TestGetPageMaxPages(t *testing.T) {
+	p := NewPageParser(NewFileFetcher("testdata/crawl"), nil, nil)
+
+	posts, attempts, truncated, err := p.getPage("", "http://textream.yahoo.co.jp/personal/history/comment?user=testuser", db.CrawlWatermark{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posts) != 2 || attempts != 1 || !truncated {
+		t.Errorf("len(posts) = %d, attempts = %d, truncated = %v; want 2, 1, true", len(posts), attempts, truncated)
+	}
+}
+
+func TestGetPageError(t *testing.T) {
+	p := NewPageParser(NewFileFetcher("testdata/crawl"), nil, nil)
+
+	// 3ページ目のfixtureは存在しないので途中で失敗する
+	posts, _, _, err := p.getPage("", "http://textream.yahoo.co.jp/personal/history/comment?user=testuser", db.CrawlWatermark{}, 0)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if posts != nil {
+		t.Errorf("posts = %v, want nil", posts)
+	}
+}
+
+func TestTrimCommentNo(t *testing.T) {
+	p := NewPageParser(nil, nil, nil)
+
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"No.123", "123", true},
+		{"\n\t　No.45 ", "45", true},
+		{"NO.6", "6", true},
+		{"123", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := p.trimCommentNo(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("trimCommentNo(%q) = %q, %v; want %q, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTrimRefNo(t *testing.T) {
+	p := NewPageParser(nil, nil, nil)
+
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{">> 12340", "12340", true},
+		{">>12340", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := p.trimRefNo(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("trimRefNo(%q) = %q, %v; want %q, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestGetHrefAndText(t *testing.T) {
+	p := NewPageParser(nil, nil, nil)
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<p><a id="a" href="http://example.com/">　text </a><a id="b">no href</a></p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	href, text, err := p.getHrefAndText(doc.Find("#a"))
+	if href != "http://example.com/" || text != "text" || err != nil {
+		t.Errorf("getHrefAndText(#a) = %q, %q, %v", href, text, err)
+	}
+
+	_, _, err = p.getHrefAndText(doc.Find("#b"))
+	if err == nil {
+		t.Errorf("getHrefAndText(#b): expected error")
+	}
+}
+
+func TestGetYahooId(t *testing.T) {
+	p := NewPageParser(nil, nil, nil)
+
+	id, err := p.getYahooId("http://textream.yahoo.co.jp/personal/history/comment?user=testuser")
+	if id != "testuser" || err != nil {
+		t.Errorf("getYahooId = %q, %v; want testuser", id, err)
+	}
+
+	_, err = p.getYahooId("http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6")
+	if err == nil {
+		t.Errorf("getYahooId: expected error")
+	}
+}
+
+// checkGolden はpostsをゴールデンファイルと比較し、異なるフィールドを報告する
+func checkGolden(t *testing.T, golden string, posts []PostDto) {
+	got, err := json.MarshalIndent(posts, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+
+	if bytes.Equal(got, want) {
+		return
+	}
+
+	for _, d := range diffPosts(got, want) {
+		t.Errorf("%s: %s", golden, d)
+	}
+}
+
+func diffPosts(got, want []byte) []string {
+	var g, w []map[string]interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		return []string{err.Error()}
+	}
+	if err := json.Unmarshal(want, &w); err != nil {
+		return []string{err.Error()}
+	}
+
+	diffs := make([]string, 0)
+
+	if len(g) != len(w) {
+		diffs = append(diffs, fmt.Sprintf("len(posts) = %d, want %d", len(g), len(w)))
+	}
+
+	for i := 0; i < len(g) && i < len(w); i++ {
+		keys := make([]string, 0, len(w[i]))
+		for k := range w[i] {
+			keys = append(keys, k)
+		}
+		for k := range g[i] {
+			if _, ok := w[i][k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if !reflect.DeepEqual(g[i][k], w[i][k]) {
+				diffs = append(diffs, fmt.Sprintf("posts[%d].%s = %#v, want %#v", i, k, g[i][k], w[i][k]))
+			}
+		}
+	}
+
+	if len(diffs) == 0 {
+		diffs = append(diffs, "output differs only in formatting")
+	}
+
+	return diffs
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// RateLimiter はトークンバケットで全goroutineのリクエスト頻度を制限する
+// perHostがtrueの場合はホストごとにバケットを持つ
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	perHost bool
+	buckets map[string]*bucket
+	now     func() time.Time
+	sleep   func(time.Duration)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateは1秒あたりのリクエスト数。0以下の場合は制限しない
+func NewRateLimiter(rate float64, burst int, perHost bool) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		perHost: perHost,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}
+}
+
+// Wait はrawurlへのリクエストが許可されるまで待つ
+func (l *RateLimiter) Wait(rawurl string) {
+	if l.rate <= 0 {
+		return
+	}
+
+	if wait := l.reserve(l.key(rawurl)); wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// トークンを1つ予約し、使えるようになるまでの時間を返す
+// 足りない場合はトークンを負にして、後続のリクエストがその分だけ後ろに並ぶようにする
+func (l *RateLimiter) reserve(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / l.rate * float64(time.Second))
+}
+
+func (l *RateLimiter) key(rawurl string) string {
+	if !l.perHost {
+		return ""
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+// RateLimitedFetcher は取得前にRateLimiterで待つ
+type RateLimitedFetcher struct {
+	fetcher Fetcher
+	limiter *RateLimiter
+}
+
+func NewRateLimitedFetcher(fetcher Fetcher, limiter *RateLimiter) *RateLimitedFetcher {
+	return &RateLimitedFetcher{fetcher: fetcher, limiter: limiter}
+}
+
+func (f *RateLimitedFetcher) Fetch(rawurl string) (*goquery.Document, error) {
+	f.limiter.Wait(rawurl)
+
+	return f.fetcher.Fetch(rawurl)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(rate float64, burst int, perHost bool) (*RateLimiter, *time.Time) {
+	now := time.Date(2014, 5, 20, 0, 0, 0, 0, time.UTC)
+
+	l := NewRateLimiter(rate, burst, perHost)
+	l.now = func() time.Time { return now }
+	// 待った分だけ時計を進める
+	l.sleep = func(d time.Duration) { now = now.Add(d) }
+
+	return l, &now
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l, now := newTestRateLimiter(2, 3, false)
+	start := *now
+
+	for i := 0; i < 3; i++ {
+		l.Wait("http://textream.yahoo.co.jp/")
+	}
+
+	if d := now.Sub(start); d != 0 {
+		t.Errorf("burst requests waited %v, want 0", d)
+	}
+
+	for i := 0; i < 4; i++ {
+		l.Wait("http://textream.yahoo.co.jp/")
+	}
+
+	if d := now.Sub(start); d != 2*time.Second {
+		t.Errorf("4 requests after burst waited %v, want 2s", d)
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	l, _ := newTestRateLimiter(1, 1, false)
+
+	// 同時に来たリクエストは順番に1秒ずつ後ろに並ぶ
+	want := []time.Duration{0, time.Second, 2 * time.Second}
+	for i, w := range want {
+		if got := l.reserve(""); got != w {
+			t.Errorf("reserve #%d = %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestRateLimiterPerHost(t *testing.T) {
+	l, now := newTestRateLimiter(1, 1, true)
+	start := *now
+
+	l.Wait("http://textream.yahoo.co.jp/a")
+	l.Wait("http://example.com/a")
+
+	if d := now.Sub(start); d != 0 {
+		t.Errorf("requests to different hosts waited %v, want 0", d)
+	}
+
+	l.Wait("http://textream.yahoo.co.jp/b")
+
+	if d := now.Sub(start); d != time.Second {
+		t.Errorf("second request to same host waited %v, want 1s", d)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l, now := newTestRateLimiter(0, 1, false)
+	start := *now
+
+	for i := 0; i < 10; i++ {
+		l.Wait("http://textream.yahoo.co.jp/")
+	}
+
+	if d := now.Sub(start); d != 0 {
+		t.Errorf("unlimited requests waited %v, want 0", d)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"../util"
+)
+
+// RetryPolicy は一時的な取得失敗に対するリトライ間隔を決める
+type RetryPolicy struct {
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64
+}
+
+func NewRetryPolicy(c util.RetryConfig) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:     c.MaxAttempts,
+		InitialInterval: time.Duration(c.InitialIntervalMsec) * time.Millisecond,
+		MaxInterval:     time.Duration(c.MaxIntervalMsec) * time.Millisecond,
+		Multiplier:      c.Multiplier,
+		Jitter:          c.Jitter,
+	}
+}
+
+// attempt回目の失敗後に待つ時間
+// Retry-Afterが指定されている場合はそれより短くしないが、MaxIntervalより長くはしない
+// (不正なRetry-Afterで長時間待ち続けないようにする)
+func (r *RetryPolicy) backoff(attempt int, err error) time.Duration {
+	d := float64(r.InitialInterval) * math.Pow(r.Multiplier, float64(attempt-1))
+	if r.MaxInterval > 0 && d > float64(r.MaxInterval) {
+		d = float64(r.MaxInterval)
+	}
+
+	if r.Jitter > 0 {
+		d -= d * r.Jitter * rand.Float64()
+	}
+
+	wait := time.Duration(d)
+
+	var he *HttpError
+	if errors.As(err, &he) && he.RetryAfter > wait {
+		wait = he.RetryAfter
+		if r.MaxInterval > 0 && wait > r.MaxInterval {
+			wait = r.MaxInterval
+		}
+	}
+
+	return wait
+}
+
+// タイムアウト、接続断、429、5xxはリトライする
+// 404などそれ以外のエラーは何度取得しても同じなのでリトライしない
+func isTemporary(err error) bool {
+	var he *HttpError
+	if errors.As(err, &he) {
+		return he.StatusCode == http.StatusTooManyRequests || he.StatusCode >= 500
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&HttpError{StatusCode: 500}, true},
+		{&HttpError{StatusCode: 503}, true},
+		{&HttpError{StatusCode: 429}, true},
+		{&HttpError{StatusCode: 404}, false},
+		{&HttpError{StatusCode: 403}, false},
+		{fmt.Errorf("wrapped: %w", &HttpError{StatusCode: 502}), true},
+		{errors.New("unknown"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isTemporary(tt.err); got != tt.want {
+			t.Errorf("isTemporary(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2014, 5, 20, 6, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"120", 120 * time.Second},
+		{"-1", 0},
+		{"Tue, 20 May 2014 06:00:30 GMT", 30 * time.Second},
+		{"Tue, 20 May 2014 05:00:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.in, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := &RetryPolicy{
+		MaxAttempts:     5,
+		InitialInterval: time.Second,
+		MaxInterval:     5 * time.Second,
+		Multiplier:      2,
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := r.backoff(i+1, errors.New("x")); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+
+	if got := r.backoff(1, &HttpError{StatusCode: 503, RetryAfter: 3 * time.Second}); got != 3*time.Second {
+		t.Errorf("backoff with Retry-After = %v, want %v", got, 3*time.Second)
+	}
+
+	// Retry-AfterがMaxIntervalより長い場合はMaxIntervalで打ち切る
+	if got := r.backoff(1, &HttpError{StatusCode: 503, RetryAfter: time.Hour}); got != r.MaxInterval {
+		t.Errorf("backoff with Retry-After = %v, want %v", got, r.MaxInterval)
+	}
+
+	r.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := r.backoff(3, errors.New("x")); got < 2*time.Second || got > 4*time.Second {
+			t.Fatalf("backoff with jitter = %v, want between 2s and 4s", got)
+		}
+	}
+}
+
+func TestFetchRetry(t *testing.T) {
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		switch {
+		case r.URL.Path == "/notfound":
+			http.NotFound(w, r)
+		case count < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, "<html><body></body></html>")
+		}
+	}))
+	defer ts.Close()
+
+	p := NewPageParser(NewHttpFetcher(nil), &RetryPolicy{
+		MaxAttempts:     3,
+		InitialInterval: time.Millisecond,
+		Multiplier:      2,
+	}, nil)
+
+	_, attempts, err := p.fetch(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+
+	count = 0
+	_, attempts, err = p.fetch(ts.URL + "/notfound")
+	if err == nil {
+		t.Error("expected error for 404")
+	}
+	if attempts != 1 {
+		t.Errorf("attempts = %d, want 1 (404 is not retried)", attempts)
+	}
+
+	count = -10
+	_, attempts, err = p.fetch(ts.URL + "/")
+	if err == nil {
+		t.Error("expected error after max attempts")
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../util"
+)
+
+// Schedule は次に実行する時刻を返す
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// cronが指定されていればcron式、なければ一定間隔で実行する
+func NewSchedule(c util.ScheduleConfig) (Schedule, error) {
+	if c.Cron != "" {
+		return ParseCron(c.Cron)
+	}
+
+	if c.IntervalMin <= 0 {
+		return nil, errors.New("schedule: intervalmin or cron is required")
+	}
+
+	return &IntervalSchedule{interval: time.Duration(c.IntervalMin) * time.Minute}, nil
+}
+
+type IntervalSchedule struct {
+	interval time.Duration
+}
+
+func (s *IntervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// CronSchedule は「分 時 日 月 曜日」の5フィールドのcron式
+// 各フィールドは * 、数値、範囲(1-5)、間隔(*/15, 0-30/10)、カンマ区切りのリストに対応する
+type CronSchedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// 日と曜日の両方が指定された場合は、どちらかに一致すれば実行する(cronと同じ)
+	// *だけの場合以外(*/2なども)は指定されたものとして扱う
+	domAny bool
+	dowAny bool
+}
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron: 5 fields required : %q", expr)
+	}
+
+	s := &CronSchedule{
+		domAny: isCronAny(fields[2]),
+		dowAny: isCronAny(fields[4]),
+	}
+
+	var err error
+	ranges := []struct {
+		field    *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	}
+
+	for i, r := range ranges {
+		*r.field, err = parseCronField(fields[i], r.min, r.max)
+		if err != nil {
+			return nil, fmt.Errorf("cron: %q : %v", expr, err)
+		}
+	}
+
+	// 7も日曜日として扱う
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	return s, nil
+}
+
+// isCronAny はフィールドが*だけの場合true。間隔(*/2)やリストは全ての値を含んでいても指定とみなす
+func isCronAny(field string) bool {
+	return field == "*"
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i > -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step : %s", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			if i := strings.Index(part, "-"); i > -1 {
+				lo, err = strconv.Atoi(part[:i])
+				if err == nil {
+					hi, err = strconv.Atoi(part[i+1:])
+				}
+			} else {
+				lo, err = strconv.Atoi(part)
+				hi = lo
+				if step > 1 {
+					hi = max
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("invalid value : %s", part)
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range : %s", part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// 最大でも4年先までに一致する時刻がある(2/29のみの指定など)
+	end := t.AddDate(4, 0, 0)
+
+	for t.Before(end) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s *CronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Scheduler はスケジュールに従ってjobを実行する
+// 前回のjobが終わっていない場合、その回の実行はスキップする
+type Scheduler struct {
+	schedule Schedule
+	job      func()
+
+	mu      sync.Mutex
+	running bool
+	wg      sync.WaitGroup
+}
+
+func NewScheduler(schedule Schedule, job func()) *Scheduler {
+	return &Scheduler{schedule: schedule, job: job}
+}
+
+// Run は起動直後に1回実行し、その後はstopが閉じられるまでスケジュールに従って実行する
+// stopが閉じられた場合は、実行中のjobの終了を待って戻る
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	s.trigger()
+
+	for {
+		next := s.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Println("scheduler: no next run time")
+			break
+		}
+
+		timer := time.NewTimer(next.Sub(time.Now()))
+
+		select {
+		case <-stop:
+			timer.Stop()
+			s.wg.Wait()
+			return
+		case <-timer.C:
+			s.trigger()
+		}
+	}
+
+	<-stop
+	s.wg.Wait()
+}
+
+func (s *Scheduler) trigger() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		log.Println("scheduler: previous run is still in progress, skipped")
+		return false
+	}
+
+	s.running = true
+	s.wg.Add(1)
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			s.running = false
+			s.mu.Unlock()
+			s.wg.Done()
+		}()
+
+		s.job()
+	}()
+
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronError(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q): expected error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2014/05/20は火曜日
+	from := time.Date(2014, 5, 20, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2014, 5, 20, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2014, 5, 20, 10, 15, 0, 0, time.UTC)},
+		{"5 * * * *", time.Date(2014, 5, 20, 11, 5, 0, 0, time.UTC)},
+		{"0,30 9-15 * * 1-5", time.Date(2014, 5, 20, 10, 30, 0, 0, time.UTC)},
+		{"0 9 * * 0", time.Date(2014, 5, 25, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2014, 5, 25, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// 日と曜日の両方を指定した場合はどちらかに一致すればよい
+		{"0 0 31 * 4", time.Date(2014, 5, 22, 0, 0, 0, 0, time.UTC)},
+		// 間隔の日も指定とみなすので、奇数日か月曜日
+		{"0 9 */2 * 1", time.Date(2014, 5, 21, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1", time.Date(2014, 5, 26, 9, 0, 0, 0, time.UTC)},
+		{"0 9 */2 * *", time.Date(2014, 5, 21, 9, 0, 0, 0, time.UTC)},
+		{"0 9 20 * */3", time.Date(2014, 5, 21, 9, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", tt.expr, err)
+			continue
+		}
+
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: Next = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+type stepSchedule time.Duration
+
+func (s stepSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+func TestSchedulerSkipsOverlappingRuns(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	s := NewScheduler(stepSchedule(5*time.Millisecond), func() {
+		started <- struct{}{}
+		<-release
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Run(stop)
+		close(done)
+	}()
+
+	<-started
+	// 実行中に何度かスケジュールが来ても、新しいjobは開始されない
+	time.Sleep(50 * time.Millisecond)
+	if n := len(started); n != 0 {
+		t.Errorf("%d overlapping runs started", n)
+	}
+
+	close(release)
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after stop")
+	}
+}
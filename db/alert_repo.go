@@ -0,0 +1,108 @@
+package db
+
+import (
+	"log"
+	"strings"
+)
+
+// AlertFilter はAlertRepo.Listの絞り込み条件。0の項目では絞り込まない
+type AlertFilter struct {
+	WatchRuleId int
+	// 0の場合は全件
+	Limit  int
+	Offset int
+}
+
+// AlertRepo は監視条件に該当した投稿のアラートを管理する
+type AlertRepo struct {
+	tc *TxContainer
+}
+
+func NewAlertRepo(tc *TxContainer) *AlertRepo {
+	return &AlertRepo{tc: tc}
+}
+
+func (r *AlertRepo) Add(a *Alert) error {
+	err := r.tc.Tx.Insert(a)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// List は絞り込み条件に該当する件数と、作成日時の新しい順にLimit件のアラートを返す
+func (r *AlertRepo) List(f AlertFilter) (int, []AlertView, error) {
+	var alerts []AlertView
+
+	where := make([]string, 0, 1)
+	args := make([]interface{}, 0, 3)
+
+	if f.WatchRuleId != 0 {
+		where = append(where, "A.watch_rule_id=?")
+		args = append(args, f.WatchRuleId)
+	}
+
+	sql := `select A.id as Id, A.watch_rule_id as WatchRuleId, B.name as WatchRuleName, A.seen as Seen, A.created_at as CreatedAt, C.id as PostId, C.user_id as UserId, C.brand_id as BrandId, C.comment_no as CommentNo, C.title as Title, C.url as Url, C.detail as Detail, C.post_time as PostTime, D.brand_name as BrandName, D.url as BrandUrl, E.yahoo_id as UserYahooId, E.display_name as UserDisplayName from alert A inner join watch_rule B on A.watch_rule_id = B.id inner join post C on A.post_id = C.id inner join brand D on C.brand_id = D.id inner join "user" E on C.user_id = E.id`
+	if len(where) > 0 {
+		sql += " where " + strings.Join(where, " and ")
+	}
+
+	total, err := r.tc.Tx.SelectInt("select count(*) from ("+sql+") T", args...)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return 0, nil, err
+	}
+
+	sql += " order by A.created_at desc, A.id desc"
+	if f.Limit > 0 {
+		sql += " limit ? offset ?"
+		args = append(args, f.Limit, f.Offset)
+	}
+
+	_, err = r.tc.Tx.Select(&alerts, sql, args...)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return 0, nil, err
+	}
+
+	return int(total), alerts, nil
+}
+
+// CountUnseen は未読のアラートの件数
+func (r *AlertRepo) CountUnseen() (int, error) {
+	n, err := r.tc.Tx.SelectInt("select count(*) from alert where seen=?", false)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// MarkSeen は指定したアラートを既読にする
+func (r *AlertRepo) MarkSeen(ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, true)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	_, err := r.tc.Tx.Exec("update alert set seen=? where id in ("+placeholders(len(ids))+")", args...)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
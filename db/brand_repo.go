@@ -0,0 +1,115 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+)
+
+// BrandFilter はBrandRepo.Listの絞り込み条件
+type BrandFilter struct {
+	// 空でない場合はIDで絞り込む
+	Ids []int
+	// trueの場合は投稿のある銘柄のみ
+	HasPosts bool
+}
+
+type BrandRepo struct {
+	tc *TxContainer
+}
+
+func NewBrandRepo(tc *TxContainer) *BrandRepo {
+	return &BrandRepo{tc: tc}
+}
+
+// List は銘柄と最後の投稿日時、未読の投稿数を最後の投稿が新しい順に返す
+func (r *BrandRepo) List(f BrandFilter) ([]BrandPostTimeView, error) {
+	var bs []BrandPostTimeView
+
+	where := make([]string, 0, 2)
+	args := make([]interface{}, 0, len(f.Ids))
+
+	if len(f.Ids) > 0 {
+		where = append(where, "A.id in ("+placeholders(len(f.Ids))+")")
+		for _, id := range f.Ids {
+			args = append(args, id)
+		}
+	}
+
+	if f.HasPosts {
+		where = append(where, "B.brand_id is not null")
+	}
+
+	sql := "select A.id as Id, A.brand_name as BrandName, A.url as Url, B.post_time as PostTime, coalesce(B.new_post_count, 0) as NewPostCount, C.brand_id as BrandNotificationBrandId from brand A left join (select A1.brand_id, max(A1.post_time) as post_time, count(B1.post_id) as new_post_count from post A1 left join post_notification B1 on A1.id = B1.post_id group by brand_id) B on A.id = B.brand_id left join brand_notification C on A.id = C.brand_id"
+	if len(where) > 0 {
+		sql += " where " + strings.Join(where, " and ")
+	}
+
+	// nullの順序はDBによって違うので、投稿のない銘柄を明示的に最後にする
+	sql += " order by B.post_time is null, B.post_time desc, A.id asc"
+
+	_, err := r.tc.Tx.Select(&bs, sql, args...)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return bs, nil
+}
+
+// GetByIds は見つからなかったIDを除いて、idsの順に返す
+func (r *BrandRepo) GetByIds(ids []int) ([]Brand, error) {
+	brands := make([]Brand, 0, len(ids))
+
+	for _, id := range ids {
+		obj, err := r.tc.Tx.Get(Brand{}, id)
+		if err != nil {
+			r.tc.Err = err
+			log.Println(err)
+			return nil, err
+		}
+
+		if obj == nil {
+			log.Printf("brand not found : %d", id)
+			continue
+		}
+
+		brands = append(brands, *obj.(*Brand))
+	}
+
+	return brands, nil
+}
+
+// GetByName は該当する銘柄がない場合nilを返す
+func (r *BrandRepo) GetByName(brandName string) (*Brand, error) {
+	if brandName == "" {
+		err := errors.New("brand name is empty")
+		r.tc.Err = err
+		return nil, err
+	}
+
+	var b Brand
+	err := r.tc.Tx.SelectOne(&b, "select * from brand where brand_name=?", brandName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+func (r *BrandRepo) Add(b *Brand) error {
+	err := r.tc.Tx.Insert(b)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
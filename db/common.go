@@ -1,27 +1,108 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
-	"os"
-	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/coopernurse/gorp"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 
+	"../migrations"
 	"../util"
 )
 
 const DB_PATH = "./data.db"
 
-func init() {
-	//util.LoadConfig()
-	initDb(true)
+var ErrNotOpened = errors.New("db is not opened")
+
+// プロセスで共有するDbMap。Openで作成してCloseで閉じる
+var (
+	mu      sync.Mutex
+	shared  *gorp.DbMap
+	dialect *migrations.Dialect
+)
+
+// Open はDBを開いてテーブルを登録し、必要ならマイグレーションを適用する
+// 起動時に1回呼び、終了時にCloseを呼ぶこと
+func Open() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if shared != nil {
+		return nil
+	}
+
+	dbmap, d, err := initDb(util.Cfg)
+	if err != nil {
+		return err
+	}
+
+	shared = dbmap
+	dialect = d
+
+	return nil
+}
+
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if shared == nil {
+		return nil
+	}
+
+	err := shared.Db.Close()
+	shared = nil
+
+	return err
+}
+
+func getDbMap() (*gorp.DbMap, *migrations.Dialect, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if shared == nil {
+		return nil, nil, ErrNotOpened
+	}
+
+	return shared, dialect, nil
+}
+
+// SqlDB はOpenで開いたDBとその方言を返す。migrateコマンドでマイグレーションを適用するために使う
+func SqlDB() (*sql.DB, *migrations.Dialect, error) {
+	dbmap, d, err := getDbMap()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dbmap.Db, d, nil
 }
 
 type TxContainer struct {
-	Tx  *gorp.Transaction
+	// ctxが設定されているので、SQLはctxがキャンセルされると中断される
+	Tx  gorp.SqlExecutor
 	Err error
+	Ctx context.Context
+	tx  *gorp.Transaction
+	d   *migrations.Dialect
+}
+
+// TxOptions はDoContextで開始するトランザクションの設定
+type TxOptions struct {
+	// trueの場合は書き込みがエラーになる
+	ReadOnly bool
+	// sqlite3は常にSERIALIZABLEになる
+	Isolation sql.IsolationLevel
+	// 0より大きい場合はタイムアウトするとキャンセルされる
+	Timeout time.Duration
 }
 
 func NewTxContainer() *TxContainer {
@@ -29,49 +110,81 @@ func NewTxContainer() *TxContainer {
 }
 
 func (m *TxContainer) Do(function func(tc *TxContainer) error) error {
-	var err error
+	return m.DoContext(context.Background(), nil, function)
+}
 
-	dbmap := initDb(false)
+// DoContext はctxがキャンセルされた場合、実行中のSQLを中断してロールバックする
+// optsがnilの場合はDoと同じ設定になる
+func (m *TxContainer) DoContext(ctx context.Context, opts *TxOptions, function func(tc *TxContainer) error) error {
+	if opts == nil {
+		opts = &TxOptions{}
+	}
 
-	defer dbmap.Db.Close()
+	if _, ok := isolationLevels[opts.Isolation]; !ok && opts.Isolation != sql.LevelDefault {
+		return fmt.Errorf("isolation level %v is not supported", opts.Isolation)
+	}
+
+	dbmap, d, err := getDbMap()
+	if err != nil {
+		return err
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
 
 	m.Err = nil
+	m.Ctx = ctx
+	m.d = d
 
-	m.Tx, err = dbmap.Begin()
+	m.tx, err = dbmap.WithContext(withTxOptions(ctx, opts)).(*gorp.DbMap).Begin()
 	if err != nil {
 		return err
 	}
 
+	m.Tx = &executor{SqlExecutor: m.tx.WithContext(ctx), d: d}
+
+	err = beginTx(d, m.Tx, opts)
+	if err != nil {
+		m.tx.Rollback()
+		return err
+	}
+
 	err = function(m)
+	if err == nil {
+		err = m.Err
+	}
+
+	if e := endTx(d, m.Tx, opts); err == nil {
+		err = e
+	}
 
 	if err != nil {
-		m.Tx.Rollback()
+		m.tx.Rollback()
 		return err
-	} else if m.Err != nil {
-		m.Tx.Rollback()
-		return m.Err
-	} else {
-		m.Tx.Commit()
 	}
 
-	return nil
+	return m.tx.Commit()
 }
 
-func initDb(createTable bool) *gorp.DbMap {
-	//db, err := sql.Open("sqlite3", DB_PATH)
-	path := util.Cfg.DBFile
-	if !filepath.IsAbs(path) {
-		path = filepath.Join(os.Getenv("GOPATH"), path)
+func initDb(cfg *util.Config) (*gorp.DbMap, *migrations.Dialect, error) {
+	d, err := migrations.GetDialect(cfg.DB.Dialect)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	db, err := sql.Open("sqlite3", path)
-
+	//db, err := sql.Open("sqlite3", DB_PATH)
+	db, err := openDb(cfg.DataSource())
 	if err != nil {
-		log.Fatalln(err)
-		// return err
+		return nil, nil, err
 	}
 
-	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
+	db.SetMaxOpenConns(cfg.DB.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.DB.MaxIdleConns)
+
+	dbmap := &gorp.DbMap{Db: db, Dialect: gorpDialect(d), TypeConverter: timeConverter{}}
 
 	//dbmap.TraceOn("[gorp]", log.New(os.Stdout, "myapp:", log.Lmicroseconds))
 
@@ -81,6 +194,7 @@ func initDb(createTable bool) *gorp.DbMap {
 	t.ColMap("YahooId").Rename("yahoo_id").SetNotNull(true)
 	t.ColMap("DisplayName").Rename("display_name").SetNotNull(false)
 	t.ColMap("Url").Rename("url").SetNotNull(true)
+	t.ColMap("Active").Rename("active").SetNotNull(true)
 
 	t = dbmap.AddTableWithName(Brand{}, "brand").SetKeys(true, "Id")
 	t.ColMap("Id").Rename("id")
@@ -106,13 +220,84 @@ func initDb(createTable bool) *gorp.DbMap {
 	t = dbmap.AddTableWithName(PostNotification{}, "post_notification").SetKeys(false, "PostId")
 	t.ColMap("PostId").Rename("post_id")
 
-	if createTable {
-		err = dbmap.CreateTablesIfNotExists()
-		if err != nil {
-			log.Fatalln(err)
-			//return err
-		}
+	t = dbmap.AddTableWithName(CrawlWatermark{}, "crawl_watermark").SetKeys(false, "UserId")
+	t.ColMap("UserId").Rename("user_id")
+	t.ColMap("Url").Rename("url").SetNotNull(true)
+	t.ColMap("CommentNo").Rename("comment_no").SetNotNull(true)
+	t.ColMap("PostTime").Rename("post_time")
+
+	t = dbmap.AddTableWithName(BoardWatermark{}, "board_watermark").SetKeys(false, "BrandId")
+	t.ColMap("BrandId").Rename("brand_id")
+	t.ColMap("Url").Rename("url").SetNotNull(true)
+	t.ColMap("CommentNo").Rename("comment_no").SetNotNull(true)
+	t.ColMap("PostTime").Rename("post_time")
+
+	t = dbmap.AddTableWithName(CrawlState{}, "crawl_state").SetKeys(false, "JobKey")
+	t.ColMap("JobKey").Rename("job_key")
+	t.ColMap("Url").Rename("url").SetNotNull(true)
+	t.ColMap("NextUrl").Rename("next_url").SetNotNull(true)
+	t.ColMap("Posts").Rename("posts").SetNotNull(true)
+	t.ColMap("UpdatedAt").Rename("updated_at")
+
+	t = dbmap.AddTableWithName(NotificationDelivery{}, "notification_delivery").SetKeys(true, "Id")
+	t.ColMap("Id").Rename("id")
+	t.ColMap("Channel").Rename("channel").SetNotNull(true)
+	t.ColMap("PostId").Rename("post_id").SetNotNull(true)
+	t.ColMap("Status").Rename("status").SetNotNull(true)
+	t.ColMap("Attempts").Rename("attempts").SetNotNull(true)
+	t.ColMap("Error").Rename("error").SetNotNull(false)
+	t.ColMap("DeliveredAt").Rename("delivered_at")
+
+	t = dbmap.AddTableWithName(WatchRule{}, "watch_rule").SetKeys(true, "Id")
+	t.ColMap("Id").Rename("id")
+	t.ColMap("Name").Rename("name").SetNotNull(true)
+	t.ColMap("Pattern").Rename("pattern").SetNotNull(true).SetMaxSize(1000)
+	t.ColMap("MatchType").Rename("match_type").SetNotNull(true)
+	t.ColMap("Target").Rename("target").SetNotNull(true)
+	t.ColMap("UserId").Rename("user_id").SetNotNull(false)
+	t.ColMap("BrandId").Rename("brand_id").SetNotNull(false)
+	t.ColMap("Enabled").Rename("enabled").SetNotNull(true)
+	t.ColMap("CreatedAt").Rename("created_at")
+	t.ColMap("UpdatedAt").Rename("updated_at")
+
+	t = dbmap.AddTableWithName(Alert{}, "alert").SetKeys(true, "Id")
+	t.ColMap("Id").Rename("id")
+	t.ColMap("WatchRuleId").Rename("watch_rule_id").SetNotNull(true)
+	t.ColMap("PostId").Rename("post_id").SetNotNull(true)
+	t.ColMap("Seen").Rename("seen").SetNotNull(true)
+	t.ColMap("CreatedAt").Rename("created_at")
+
+	migrations.UsersJsonFile = cfg.UsersJsonPath()
+
+	err = migrate(db, d, cfg.AutoMigrate)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
 	}
 
-	return dbmap
+	return dbmap, d, nil
+}
+
+// テーブルやインデックスはmigrationsで作成する
+// automigrateがfalseの場合は適用せず、未適用のものがあることだけを警告する
+func migrate(db *sql.DB, d *migrations.Dialect, autoMigrate bool) error {
+	if autoMigrate {
+		return migrations.Up(db, d, 0)
+	}
+
+	current, err := migrations.Current(db, d)
+	if err != nil {
+		return err
+	}
+
+	if current < migrations.Latest() {
+		log.Printf("schema version %d is older than %d. run migrate up", current, migrations.Latest())
+	}
+
+	return nil
+}
+
+// placeholders はin句に使うn個の?
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
 }
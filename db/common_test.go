@@ -0,0 +1,292 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coopernurse/gorp"
+
+	"../migrations"
+	"../util"
+)
+
+// withoutShared はTestMainで開いたDBを退避して、Openしていない状態でfunctionを実行する
+func withoutShared(t *testing.T, function func()) {
+	mu.Lock()
+	saved, savedDialect := shared, dialect
+	shared, dialect = nil, nil
+	mu.Unlock()
+
+	defer func() {
+		mu.Lock()
+		shared, dialect = saved, savedDialect
+		mu.Unlock()
+	}()
+
+	function()
+}
+
+func TestNotOpened(t *testing.T) {
+	withoutShared(t, func() {
+		called := false
+		err := NewTxContainer().Do(func(tc *TxContainer) error {
+			called = true
+			return nil
+		})
+		if err != ErrNotOpened {
+			t.Errorf("Do() = %v, want ErrNotOpened", err)
+		}
+
+		if called {
+			t.Error("function is called")
+		}
+
+		// 開いていない場合のCloseは何もしない
+		if err = Close(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOpenClose(t *testing.T) {
+	if os.Getenv("TEST_DB_DIALECT") != "" {
+		t.Skip("sqlite3 only")
+	}
+
+	dir, err := ioutil.TempDir("", "yahoo_textream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := *util.Cfg
+	cfg.DBFile = filepath.Join(dir, "data.db")
+	cfg.AutoMigrate = true
+	cfg.DB = util.DBConfig{MaxOpenConns: 3, MaxIdleConns: 1, BusyTimeoutMsec: 1234, WAL: true}
+
+	saved := util.Cfg
+	util.Cfg = &cfg
+	defer func() { util.Cfg = saved }()
+
+	withoutShared(t, func() {
+		if err := Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		first, _, err := getDbMap()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 2回目のOpenは開いているDBをそのまま使う
+		if err = Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		if second, _, _ := getDbMap(); second != first {
+			t.Error("Open() should reuse the opened db")
+		}
+
+		checkSettings(t, first)
+
+		if err = Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err = getDbMap(); err != ErrNotOpened {
+			t.Errorf("getDbMap() after Close = %v, want ErrNotOpened", err)
+		}
+	})
+}
+
+func checkSettings(t *testing.T, dbmap *gorp.DbMap) {
+	if n := dbmap.Db.Stats().MaxOpenConnections; n != 3 {
+		t.Errorf("MaxOpenConnections = %d, want 3", n)
+	}
+
+	// 接続ごとの設定なので、トランザクションの接続で確認する
+	err := NewTxContainer().Do(func(tc *TxContainer) error {
+		mode, err := tc.Tx.SelectStr("pragma journal_mode")
+		if err != nil {
+			return err
+		}
+
+		if mode != "wal" {
+			t.Errorf("journal_mode = %s, want wal", mode)
+		}
+
+		timeout, err := tc.Tx.SelectInt("pragma busy_timeout")
+		if err != nil {
+			return err
+		}
+
+		if timeout != 1234 {
+			t.Errorf("busy_timeout = %d, want 1234", timeout)
+		}
+
+		current, err := tc.Tx.SelectInt("select max(version) from schema_version")
+		if err != nil {
+			return err
+		}
+
+		if int(current) != migrations.Latest() {
+			t.Errorf("schema version = %d, want %d", current, migrations.Latest())
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowQuery は中断されるまで終わらないクエリ
+func slowQuery(tc *TxContainer) error {
+	query := "with recursive c(x) as (select 1 union all select x+1 from c) select count(*) from c"
+	if tc.d.IsMySQL() {
+		query = "select sleep(10)"
+	}
+
+	_, err := tc.Tx.SelectInt(query)
+
+	return err
+}
+
+func TestDoContextTimeout(t *testing.T) {
+	start := time.Now()
+	err := NewTxContainer().DoContext(context.Background(), &TxOptions{Timeout: 100 * time.Millisecond}, slowQuery)
+	if err == nil {
+		t.Fatal("DoContext() should fail")
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("query is not aborted : %v", d)
+	}
+}
+
+func TestDoContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := NewTxContainer().DoContext(ctx, nil, slowQuery)
+	if err == nil {
+		t.Fatal("DoContext() should fail")
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("query is not aborted : %v", d)
+	}
+
+	// キャンセルされた後も他のトランザクションは使える
+	err = NewTxContainer().Do(func(tc *TxContainer) error {
+		_, err := tc.Tx.SelectInt("select 1")
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDoContextReadOnly(t *testing.T) {
+	opts := &TxOptions{ReadOnly: true}
+
+	err := NewTxContainer().DoContext(context.Background(), opts, func(tc *TxContainer) error {
+		if _, err := tc.Tx.SelectInt(`select count(*) from "user"`); err != nil {
+			t.Errorf("read in read-only transaction : %v", err)
+		}
+
+		return NewUserRepo(tc).Add(&User{YahooId: "readonly", Url: "http://example.com/readonly"})
+	})
+	if err == nil {
+		t.Fatal("write in read-only transaction should fail")
+	}
+
+	// 読み込み専用の設定は次のトランザクションに残らない
+	withTx(t, func(tc *TxContainer) {
+		if err := NewUserRepo(tc).Add(&User{YahooId: "readonly", Url: "http://example.com/readonly"}); err != nil {
+			t.Errorf("write after read-only transaction : %v", err)
+		}
+	})
+}
+
+func TestDoContextIsolation(t *testing.T) {
+	_, d, err := getDbMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := "show transaction_isolation"
+	want := "read committed"
+	switch {
+	case d.IsSQLite():
+		t.Skip("sqlite3 is always serializable")
+	case d.IsMySQL():
+		query = "select @@transaction_isolation"
+		want = "READ-COMMITTED"
+	}
+
+	opts := &TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true}
+	err = NewTxContainer().DoContext(context.Background(), opts, func(tc *TxContainer) error {
+		level, err := tc.Tx.SelectStr(query)
+		if err != nil {
+			return err
+		}
+
+		if level != want {
+			t.Errorf("isolation level = %s, want %s", level, want)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDoContextRollback(t *testing.T) {
+	errTest := errors.New("test")
+
+	tests := []func(tc *TxContainer) error{
+		// functionがエラーを返した場合
+		func(tc *TxContainer) error {
+			return errTest
+		},
+		// リポジトリがtc.Errにエラーを設定した場合
+		func(tc *TxContainer) error {
+			tc.Err = errTest
+			return nil
+		},
+	}
+
+	for i, test := range tests {
+		err := NewTxContainer().Do(func(tc *TxContainer) error {
+			if err := NewUserRepo(tc).Add(&User{YahooId: "rollback", Url: "http://example.com/rollback"}); err != nil {
+				t.Fatal(err)
+			}
+
+			return test(tc)
+		})
+		if err != errTest {
+			t.Errorf("%d: Do() = %v, want %v", i, err, errTest)
+		}
+
+		err = NewTxContainer().Do(func(tc *TxContainer) error {
+			u, err := NewUserRepo(tc).GetByYahooId("rollback")
+			if u != nil {
+				t.Errorf("%d: user is not rolled back", i)
+			}
+
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// CrawlRepo はユーザーと掲示板ごとの取得位置と、取得の途中経過を管理する
+type CrawlRepo struct {
+	tc *TxContainer
+}
+
+func NewCrawlRepo(tc *TxContainer) *CrawlRepo {
+	return &CrawlRepo{tc: tc}
+}
+
+// GetWatermarks はユーザーIDごとの取得位置を返す
+func (r *CrawlRepo) GetWatermarks() (map[int]CrawlWatermark, error) {
+	var ws []CrawlWatermark
+	_, err := r.tc.Tx.Select(&ws, "select * from crawl_watermark")
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	marks := make(map[int]CrawlWatermark, len(ws))
+	for _, w := range ws {
+		marks[w.UserId] = w
+	}
+
+	return marks, nil
+}
+
+func (r *CrawlRepo) SaveWatermark(w *CrawlWatermark) error {
+	n, err := r.tc.Tx.Update(w)
+	if err == nil && n == 0 {
+		err = r.tc.Tx.Insert(w)
+	}
+
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// GetBoardWatermarks は銘柄IDごとの掲示板の取得位置を返す
+func (r *CrawlRepo) GetBoardWatermarks() (map[int]BoardWatermark, error) {
+	var ws []BoardWatermark
+	_, err := r.tc.Tx.Select(&ws, "select * from board_watermark")
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	marks := make(map[int]BoardWatermark, len(ws))
+	for _, w := range ws {
+		marks[w.BrandId] = w
+	}
+
+	return marks, nil
+}
+
+func (r *CrawlRepo) SaveBoardWatermark(w *BoardWatermark) error {
+	n, err := r.tc.Tx.Update(w)
+	if err == nil && n == 0 {
+		err = r.tc.Tx.Insert(w)
+	}
+
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// GetState は途中経過がない場合nilを返す
+func (r *CrawlRepo) GetState(jobKey string) (*CrawlState, error) {
+	var cs CrawlState
+	err := r.tc.Tx.SelectOne(&cs, "select * from crawl_state where job_key=?", jobKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return &cs, nil
+}
+
+func (r *CrawlRepo) SaveState(cs *CrawlState) error {
+	cs.UpdatedAt = time.Now()
+
+	n, err := r.tc.Tx.Update(cs)
+	if err == nil && n == 0 {
+		err = r.tc.Tx.Insert(cs)
+	}
+
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *CrawlRepo) DeleteState(jobKey string) error {
+	_, err := r.tc.Tx.Exec("delete from crawl_state where job_key=?", jobKey)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
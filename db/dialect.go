@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/coopernurse/gorp"
+
+	"../migrations"
+)
+
+func gorpDialect(d *migrations.Dialect) gorp.Dialect {
+	switch d.Name {
+	case "postgres":
+		return gorp.PostgresDialect{}
+	case "mysql":
+		return gorp.MySQLDialect{Engine: "InnoDB", Encoding: "utf8mb4"}
+	default:
+		return gorp.SqliteDialect{}
+	}
+}
+
+// executor はクエリをDBに合わせて書き換えてから実行する
+// Insert、Update、Get、DeleteはgorpがDBに合わせたSQLを作成する
+type executor struct {
+	gorp.SqlExecutor
+	d *migrations.Dialect
+}
+
+func (e *executor) WithContext(ctx context.Context) gorp.SqlExecutor {
+	return &executor{SqlExecutor: e.SqlExecutor.WithContext(ctx), d: e.d}
+}
+
+func (e *executor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return e.SqlExecutor.Exec(e.d.Rebind(query), args...)
+}
+
+func (e *executor) Select(i interface{}, query string, args ...interface{}) ([]interface{}, error) {
+	return e.SqlExecutor.Select(i, e.d.Rebind(query), args...)
+}
+
+func (e *executor) SelectInt(query string, args ...interface{}) (int64, error) {
+	return e.SqlExecutor.SelectInt(e.d.Rebind(query), args...)
+}
+
+func (e *executor) SelectNullInt(query string, args ...interface{}) (sql.NullInt64, error) {
+	return e.SqlExecutor.SelectNullInt(e.d.Rebind(query), args...)
+}
+
+func (e *executor) SelectFloat(query string, args ...interface{}) (float64, error) {
+	return e.SqlExecutor.SelectFloat(e.d.Rebind(query), args...)
+}
+
+func (e *executor) SelectNullFloat(query string, args ...interface{}) (sql.NullFloat64, error) {
+	return e.SqlExecutor.SelectNullFloat(e.d.Rebind(query), args...)
+}
+
+func (e *executor) SelectStr(query string, args ...interface{}) (string, error) {
+	return e.SqlExecutor.SelectStr(e.d.Rebind(query), args...)
+}
+
+func (e *executor) SelectNullStr(query string, args ...interface{}) (sql.NullString, error) {
+	return e.SqlExecutor.SelectNullStr(e.d.Rebind(query), args...)
+}
+
+func (e *executor) SelectOne(holder interface{}, query string, args ...interface{}) error {
+	return e.SqlExecutor.SelectOne(holder, e.d.Rebind(query), args...)
+}
+
+func (e *executor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return e.SqlExecutor.Query(e.d.Rebind(query), args...)
+}
+
+func (e *executor) QueryRow(query string, args ...interface{}) *sql.Row {
+	return e.SqlExecutor.QueryRow(e.d.Rebind(query), args...)
+}
+
+// DoContextで指定できる分離レベル
+var isolationLevels = map[sql.IsolationLevel]bool{
+	sql.LevelReadUncommitted: true,
+	sql.LevelReadCommitted:   true,
+	sql.LevelRepeatableRead:  true,
+	sql.LevelSerializable:    true,
+}
+
+// beginTx は開始したトランザクションにoptsを設定する
+//
+// mysqlとpostgresはドライバがBeginTxで設定するので何もしない(withTxOptions)
+// sqlite3は常にSERIALIZABLEなので、読み込み専用だけを接続のquery_onlyで設定する
+func beginTx(d *migrations.Dialect, tx gorp.SqlExecutor, opts *TxOptions) error {
+	if d.Name == "sqlite3" && opts.ReadOnly {
+		return setQueryOnly(tx, true)
+	}
+
+	return nil
+}
+
+// endTx はコミット、ロールバックの前に接続の設定を元に戻す
+// (キャンセルされた場合は接続ごと破棄される)
+func endTx(d *migrations.Dialect, tx gorp.SqlExecutor, opts *TxOptions) error {
+	if d.Name == "sqlite3" && opts.ReadOnly {
+		return setQueryOnly(tx, false)
+	}
+
+	return nil
+}
+
+func setQueryOnly(tx gorp.SqlExecutor, on bool) error {
+	v := 0
+	if on {
+		v = 1
+	}
+
+	_, err := tx.Exec(fmt.Sprintf("pragma query_only = %d", v))
+
+	return err
+}
@@ -5,21 +5,23 @@ import (
 	"time"
 )
 
+// User はActiveがtrueの場合、バッチでUrlのページから投稿を取得する
 type User struct {
 	Id          int
 	YahooId     string
 	DisplayName sql.NullString
 	Url         string
+	Active      bool
 }
 
 type UserPostTimeView struct {
-	Id             int
-	YahooId        string
-	DisplayName    sql.NullString
-	Url            string
-	PostTimeString sql.NullString
-	PostTime       time.Time
-	NewPostCount   int
+	Id           int
+	YahooId      string
+	DisplayName  sql.NullString
+	Url          string
+	Active       bool
+	PostTime     time.Time
+	NewPostCount int
 }
 
 type Brand struct {
@@ -32,7 +34,6 @@ type BrandPostTimeView struct {
 	Id                       int
 	BrandName                string
 	Url                      string
-	PostTimeString           string
 	PostTime                 time.Time
 	NewPostCount             int
 	BrandNotificationBrandId sql.NullInt64
@@ -70,8 +71,131 @@ type PostView struct {
 	BrandName              string
 	BrandUrl               string
 	PostNotificationPostId sql.NullInt64
+	UserYahooId            string
+	UserDisplayName        sql.NullString
 }
 
 type PostNotification struct {
 	PostId int
 }
+
+const (
+	DeliverySent   = "sent"
+	DeliveryFailed = "failed"
+)
+
+// NotificationDelivery は新規投稿の通知の送信結果
+// Statusは送信できた場合DeliverySent、リトライしても失敗した場合DeliveryFailed
+type NotificationDelivery struct {
+	Id          int
+	Channel     string
+	PostId      int
+	Status      string
+	Attempts    int
+	Error       sql.NullString
+	DeliveredAt time.Time
+}
+
+// WatchRuleのMatchType
+const (
+	// Patternを空白で区切った語を全て含む。全角と半角、ひらがなとカタカナ、大文字と小文字を区別しない
+	MatchKeyword = "keyword"
+	// Patternを正規表現(regexp)として扱う
+	MatchRegex = "regex"
+)
+
+// WatchRuleのTarget
+const (
+	TargetAll    = "all"
+	TargetTitle  = "title"
+	TargetDetail = "detail"
+)
+
+// WatchRule は投稿の監視条件。設定した条件を全て満たす新規投稿でアラートを作成する
+// Patternが空の場合は本文で、UserIdとBrandIdがnullの場合はユーザーと銘柄で絞り込まない
+type WatchRule struct {
+	Id        int
+	Name      string
+	Pattern   string
+	MatchType string
+	Target    string
+	UserId    sql.NullInt64
+	BrandId   sql.NullInt64
+	Enabled   bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// WatchRuleView は監視条件に対象のユーザー、銘柄の名前とアラートの件数を加えたもの
+type WatchRuleView struct {
+	Id              int
+	Name            string
+	Pattern         string
+	MatchType       string
+	Target          string
+	UserId          sql.NullInt64
+	BrandId         sql.NullInt64
+	Enabled         bool
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	UserYahooId     sql.NullString
+	UserDisplayName sql.NullString
+	BrandName       sql.NullString
+	AlertCount      int
+}
+
+// Alert は監視条件に該当した投稿。Seenはアラートの一覧で表示するとtrueになる
+type Alert struct {
+	Id          int
+	WatchRuleId int
+	PostId      int
+	Seen        bool
+	CreatedAt   time.Time
+}
+
+// AlertView はアラートに監視条件の名前と投稿を加えたもの
+type AlertView struct {
+	Id              int
+	WatchRuleId     int
+	WatchRuleName   string
+	Seen            bool
+	CreatedAt       time.Time
+	PostId          int
+	UserId          int
+	BrandId         int
+	CommentNo       string
+	Title           string
+	Url             string
+	Detail          string
+	PostTime        time.Time
+	BrandName       string
+	BrandUrl        string
+	UserYahooId     string
+	UserDisplayName sql.NullString
+}
+
+// CrawlWatermark はユーザーごとに最後に取得した投稿
+type CrawlWatermark struct {
+	UserId    int
+	Url       string
+	CommentNo string
+	PostTime  time.Time
+}
+
+// BoardWatermark は銘柄の掲示板ごとに最後に取得した投稿
+type BoardWatermark struct {
+	BrandId   int
+	Url       string
+	CommentNo string
+	PostTime  time.Time
+}
+
+// CrawlState はページの取得を途中で中断した場合の続きの位置
+// JobKeyは取得対象と取得方法、Urlは取得を開始したページ、Postsは取得済みの投稿(JSON)
+type CrawlState struct {
+	JobKey    string
+	Url       string
+	NextUrl   string
+	Posts     string
+	UpdatedAt time.Time
+}
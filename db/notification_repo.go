@@ -0,0 +1,95 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// NotificationRepo は新着の銘柄と未読の投稿を管理する
+type NotificationRepo struct {
+	tc *TxContainer
+}
+
+func NewNotificationRepo(tc *TxContainer) *NotificationRepo {
+	return &NotificationRepo{tc: tc}
+}
+
+func (r *NotificationRepo) AddBrand(bn *BrandNotification) error {
+	err := r.tc.Tx.Insert(bn)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *NotificationRepo) AddPost(pn *PostNotification) error {
+	err := r.tc.Tx.Insert(pn)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// DeletePosts は指定した投稿を既読にする
+func (r *NotificationRepo) DeletePosts(ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	_, err := r.tc.Tx.Exec("delete from post_notification where post_id in ("+placeholders(len(ids))+")", args...)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteBrandsBefore はt以前に追加された銘柄を新着から外す
+func (r *NotificationRepo) DeleteBrandsBefore(t time.Time) error {
+	_, err := r.tc.Tx.Exec("delete from brand_notification where post_time<?", ToDbTime(t))
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// AddDelivery は通知の送信結果を記録する
+func (r *NotificationRepo) AddDelivery(d *NotificationDelivery) error {
+	err := r.tc.Tx.Insert(d)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// ListDeliveries は投稿の通知の送信結果を記録した順に返す
+func (r *NotificationRepo) ListDeliveries(postId int) ([]NotificationDelivery, error) {
+	var ds []NotificationDelivery
+	_, err := r.tc.Tx.Select(&ds, "select * from notification_delivery where post_id=? order by id", postId)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return ds, nil
+}
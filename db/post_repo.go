@@ -0,0 +1,200 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// PostFilter はPostRepo.Listの絞り込み条件。0の項目では絞り込まない
+type PostFilter struct {
+	UserId  int
+	BrandId int
+	// 0の場合は全件
+	Limit  int
+	Offset int
+}
+
+type PostRepo struct {
+	tc *TxContainer
+}
+
+func NewPostRepo(tc *TxContainer) *PostRepo {
+	return &PostRepo{tc: tc}
+}
+
+// List は絞り込み条件に該当する件数と、投稿日時の新しい順にLimit件の投稿を返す
+func (r *PostRepo) List(f PostFilter) (int, []PostView, error) {
+	where := make([]string, 0, 2)
+	args := make([]interface{}, 0, 4)
+
+	if f.UserId != 0 {
+		where = append(where, "A.user_id=?")
+		args = append(args, f.UserId)
+	}
+
+	if f.BrandId != 0 {
+		where = append(where, "A.brand_id=?")
+		args = append(args, f.BrandId)
+	}
+
+	return r.list(where, args, f.Limit, f.Offset)
+}
+
+func (r *PostRepo) list(where []string, args []interface{}, limit int, offset int) (int, []PostView, error) {
+	var posts []PostView
+
+	sql := `select A.id as Id, A.user_id as UserId, A.brand_id as BrandId, A.comment_no as CommentNo, A.title as Title, A.url as Url, A.ref_no as RefNo, A.ref_url as RefUrl, A.detail as Detail, A.post_time as PostTime, B.brand_name as BrandName, B.url as BrandUrl, C.post_id as PostNotificationPostId, D.yahoo_id as UserYahooId, D.display_name as UserDisplayName from post A inner join brand B on A.brand_id = B.id left join post_notification C on A.id = C.post_id inner join "user" D on A.user_id = D.id`
+	if len(where) > 0 {
+		sql += " where " + strings.Join(where, " and ")
+	}
+
+	total, err := r.tc.Tx.SelectInt("select count(*) from ("+sql+") T", args...)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return 0, nil, err
+	}
+
+	sql += " order by A.post_time desc"
+	if limit > 0 {
+		sql += " limit ? offset ?"
+		args = append(args, limit, offset)
+	}
+
+	_, err = r.tc.Tx.Select(&posts, sql, args...)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return 0, nil, err
+	}
+
+	return int(total), posts, nil
+}
+
+// GetView は銘柄名などを含めた投稿を返す。該当する投稿がない場合nilを返す
+func (r *PostRepo) GetView(id int) (*PostView, error) {
+	_, posts, err := r.list([]string{"A.id=?"}, []interface{}{id}, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(posts) == 0 {
+		return nil, nil
+	}
+
+	return &posts[0], nil
+}
+
+// GetByUrl は該当する投稿がない場合nilを返す
+func (r *PostRepo) GetByUrl(url string) (*Post, error) {
+	var p Post
+	err := r.tc.Tx.SelectOne(&p, "select * from post where url=?", url)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// Save は同じURLの投稿が保存済みの場合は内容(タイトル、本文、参照先)だけを更新する
+// 保存済みの投稿のユーザーと銘柄は変更せず、pにも保存済みの値を設定する
+// 新規に保存した場合はtrueを返す
+//
+// 同時に実行された取得が同じ投稿を保存しても一意制約のエラーにならないように、
+// 確認してから追加するのではなく、追加して重複した場合に更新する
+func (r *PostRepo) Save(p *Post) (bool, error) {
+	isNew, err := r.insertIfNotExist(p)
+	if err != nil {
+		return false, err
+	}
+
+	if !isNew {
+		_, err = r.tc.Tx.Exec("update post set title=?, detail=?, ref_no=?, ref_url=? where id=?", p.Title, p.Detail, p.RefNo, p.RefUrl, p.Id)
+		if err != nil {
+			r.tc.Err = err
+			log.Println(err)
+			return false, err
+		}
+
+		exist, err := r.GetByUrl(p.Url)
+		if err != nil {
+			return false, err
+		}
+
+		if exist == nil {
+			err = fmt.Errorf("post not found : %s", p.Url)
+			r.tc.Err = err
+			return false, err
+		}
+
+		p.UserId = exist.UserId
+		p.BrandId = exist.BrandId
+	}
+
+	return isNew, NewSearchRepo(r.tc).Index(p)
+}
+
+// insertIfNotExist は同じURLの投稿がない場合のみ追加し、追加した場合trueを返す
+// どちらの場合もp.Idに保存されている投稿のIDを設定する
+func (r *PostRepo) insertIfNotExist(p *Post) (bool, error) {
+	insert := "insert into post (user_id, brand_id, comment_no, title, url, ref_no, ref_url, detail, post_time) values (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	args := []interface{}{p.UserId, p.BrandId, p.CommentNo, p.Title, p.Url, p.RefNo, p.RefUrl, p.Detail, ToDbTime(p.PostTime)}
+
+	// mysqlは重複した場合もLAST_INSERT_IDで既存の投稿のIDを返す(変更がないので更新件数は0)
+	if r.tc.d.IsMySQL() {
+		res, err := r.tc.Tx.Exec(insert+" on duplicate key update id=LAST_INSERT_ID(id)", args...)
+		if err != nil {
+			r.tc.Err = err
+			log.Println(err)
+			return false, err
+		}
+
+		n, err := res.RowsAffected()
+		if err == nil {
+			var id int64
+			id, err = res.LastInsertId()
+			p.Id = int(id)
+		}
+
+		if err != nil {
+			r.tc.Err = err
+			log.Println(err)
+			return false, err
+		}
+
+		return n == 1, nil
+	}
+
+	id, err := r.tc.Tx.SelectNullInt(insert+" on conflict (url) do nothing returning id", args...)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return false, err
+	}
+
+	if id.Valid {
+		p.Id = int(id.Int64)
+		return true, nil
+	}
+
+	exist, err := r.GetByUrl(p.Url)
+	if err != nil {
+		return false, err
+	}
+
+	if exist == nil {
+		err = fmt.Errorf("post not found : %s", p.Url)
+		r.tc.Err = err
+		return false, err
+	}
+
+	p.Id = exist.Id
+
+	return false, nil
+}
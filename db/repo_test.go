@@ -0,0 +1,813 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+// テストは一時ディレクトリのsqlite3のDBで行い、各テストの変更はロールバックする
+// TEST_DB_DIALECTとTEST_DB_DSNを指定した場合はそのDBでテストする(テスト専用の空のDBを指定すること)
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "yahoo_textream")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	cfg := *util.Cfg
+	cfg.DBFile = filepath.Join(dir, "data.db")
+	cfg.AutoMigrate = true
+	cfg.DB.Dialect = os.Getenv("TEST_DB_DIALECT")
+	cfg.DB.DSN = os.Getenv("TEST_DB_DSN")
+
+	shared, dialect, err = initDb(&cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	code := m.Run()
+
+	Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+var errRollback = errors.New("rollback")
+
+func withTx(t *testing.T, function func(tc *TxContainer)) {
+	err := NewTxContainer().Do(func(tc *TxContainer) error {
+		function(tc)
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatal(err)
+	}
+}
+
+type fixture struct {
+	users  []User
+	brands []Brand
+	posts  []Post
+}
+
+// user1はbrand1に2件(1件未読)、user2はbrand2に1件、user3は投稿なし
+func addFixture(t *testing.T, tc *TxContainer) *fixture {
+	f := &fixture{
+		users: []User{
+			{YahooId: "user1", Url: "http://example.com/user1"},
+			{YahooId: "user2", Url: "http://example.com/user2"},
+			{YahooId: "user3", Url: "http://example.com/user3"},
+		},
+		brands: []Brand{
+			{BrandName: "brand1", Url: "http://example.com/brand1"},
+			{BrandName: "brand2", Url: "http://example.com/brand2"},
+			{BrandName: "brand3", Url: "http://example.com/brand3"},
+		},
+	}
+
+	for i := range f.users {
+		if _, err := NewUserRepo(tc).AddIfNotExist(&f.users[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range f.brands {
+		if err := NewBrandRepo(tc).Add(&f.brands[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	base := time.Date(2014, 6, 1, 9, 0, 0, 0, time.UTC)
+	f.posts = []Post{
+		{UserId: f.users[0].Id, BrandId: f.brands[0].Id, CommentNo: "1", Title: "t", Url: "http://example.com/1", Detail: "d", PostTime: base},
+		{UserId: f.users[0].Id, BrandId: f.brands[0].Id, CommentNo: "2", Title: "t", Url: "http://example.com/2", Detail: "d", PostTime: base.Add(2 * time.Hour)},
+		{UserId: f.users[1].Id, BrandId: f.brands[1].Id, CommentNo: "3", Title: "t", Url: "http://example.com/3", Detail: "d", PostTime: base.Add(time.Hour)},
+	}
+
+	for i := range f.posts {
+		if _, err := NewPostRepo(tc).Save(&f.posts[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := NewNotificationRepo(tc).AddPost(&PostNotification{PostId: f.posts[1].Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestPostRepoSave(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+
+		p := f.posts[0]
+		p.Id = 0
+		p.Title = "updated"
+
+		added, err := NewPostRepo(tc).Save(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if added || p.Id != f.posts[0].Id {
+			t.Errorf("Save() = %v, id %d, want false, id %d", added, p.Id, f.posts[0].Id)
+		}
+
+		got, err := NewPostRepo(tc).GetByUrl(p.Url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Title != "updated" || !got.PostTime.Equal(p.PostTime) {
+			t.Errorf("GetByUrl() = %+v", got)
+		}
+
+		view, err := NewPostRepo(tc).GetView(f.posts[1].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if view == nil || view.BrandName != "brand1" || !view.PostNotificationPostId.Valid {
+			t.Errorf("GetView() = %+v", view)
+		}
+
+		view, err = NewPostRepo(tc).GetView(-1)
+		if err != nil || view != nil {
+			t.Errorf("GetView(-1) = %+v, %v", view, err)
+		}
+	})
+}
+
+// 保存済みの投稿を保存し直しても追加されない
+func TestPostRepoSaveAgain(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewPostRepo(tc)
+
+		before, _ := tc.Tx.SelectInt("select count(*) from post")
+
+		for _, fp := range f.posts {
+			p := fp
+			p.Id = 0
+
+			added, err := repo.Save(&p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if added || p.Id != fp.Id {
+				t.Errorf("Save(%s) = %v, id %d, want false, id %d", p.Url, added, p.Id, fp.Id)
+			}
+		}
+
+		if n, _ := tc.Tx.SelectInt("select count(*) from post"); n != before {
+			t.Errorf("post count = %d, want %d", n, before)
+		}
+
+		p := Post{UserId: f.users[2].Id, BrandId: f.brands[2].Id, CommentNo: "4", Title: "t", Url: "http://example.com/4", Detail: "d", PostTime: f.posts[0].PostTime}
+		added, err := repo.Save(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, _ := repo.GetByUrl(p.Url)
+		if !added || p.Id == 0 || got == nil || got.Id != p.Id {
+			t.Errorf("Save() = %v, %+v, GetByUrl() = %+v", added, p, got)
+		}
+	})
+}
+
+// 保存済みの投稿を別のユーザーで保存し直しても、内容だけが更新される
+func TestPostRepoSaveKeepsOwner(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewPostRepo(tc)
+
+		p := f.posts[0]
+		p.Id = 0
+		p.UserId = f.users[2].Id
+		p.BrandId = f.brands[2].Id
+		p.Title = "updated"
+
+		added, err := repo.Save(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if added || p.UserId != f.posts[0].UserId || p.BrandId != f.posts[0].BrandId {
+			t.Errorf("Save() = %v, %+v", added, p)
+		}
+
+		got, err := repo.GetByUrl(p.Url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.UserId != f.posts[0].UserId || got.BrandId != f.posts[0].BrandId || got.Title != "updated" {
+			t.Errorf("GetByUrl() = %+v", got)
+		}
+	})
+}
+
+func TestPostRepoList(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewPostRepo(tc)
+
+		tests := []struct {
+			filter PostFilter
+			total  int
+			ids    []int
+		}{
+			{PostFilter{}, 3, []int{f.posts[1].Id, f.posts[2].Id, f.posts[0].Id}},
+			{PostFilter{Limit: 1, Offset: 1}, 3, []int{f.posts[2].Id}},
+			{PostFilter{UserId: f.users[0].Id}, 2, []int{f.posts[1].Id, f.posts[0].Id}},
+			{PostFilter{BrandId: f.brands[1].Id}, 1, []int{f.posts[2].Id}},
+			{PostFilter{UserId: f.users[0].Id, BrandId: f.brands[1].Id}, 0, nil},
+		}
+
+		for _, tt := range tests {
+			total, posts, err := repo.List(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := make([]int, 0, len(posts))
+			for _, p := range posts {
+				ids = append(ids, p.Id)
+			}
+
+			if total != tt.total || !equalInts(ids, tt.ids) {
+				t.Errorf("List(%+v) = %d, %v, want %d, %v", tt.filter, total, ids, tt.total, tt.ids)
+			}
+		}
+
+		_, posts, _ := repo.List(PostFilter{})
+		if !posts[0].PostNotificationPostId.Valid || posts[1].PostNotificationPostId.Valid {
+			t.Error("PostNotificationPostId is not set as expected")
+		}
+
+		if posts[0].BrandName != "brand1" {
+			t.Errorf("BrandName = %s, want brand1", posts[0].BrandName)
+		}
+	})
+}
+
+func TestUserRepoList(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewUserRepo(tc)
+
+		tests := []struct {
+			filter UserFilter
+			ids    []int
+		}{
+			{UserFilter{}, []int{f.users[0].Id, f.users[1].Id, f.users[2].Id}},
+			{UserFilter{HasPosts: true, Order: UserOrderByLastPost}, []int{f.users[0].Id, f.users[1].Id}},
+			// 投稿のないユーザーはどのDBでも最後
+			{UserFilter{Order: UserOrderByLastPost}, []int{f.users[0].Id, f.users[1].Id, f.users[2].Id}},
+			{UserFilter{YahooIds: []string{"user3", "user2"}}, []int{f.users[1].Id, f.users[2].Id}},
+		}
+
+		for _, tt := range tests {
+			users, err := repo.List(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := make([]int, 0, len(users))
+			for _, u := range users {
+				ids = append(ids, u.Id)
+			}
+
+			if !equalInts(ids, tt.ids) {
+				t.Errorf("List(%+v) = %v, want %v", tt.filter, ids, tt.ids)
+			}
+		}
+
+		users, _ := repo.List(UserFilter{})
+		if users[0].NewPostCount != 1 || !users[0].PostTime.Equal(f.posts[1].PostTime) {
+			t.Errorf("user1 = %d, %v", users[0].NewPostCount, users[0].PostTime)
+		}
+
+		if !users[2].PostTime.IsZero() {
+			t.Errorf("user3 PostTime = %v", users[2].PostTime)
+		}
+
+		u, err := repo.Get(f.users[1].Id)
+		if err != nil || u == nil || u.YahooId != "user2" {
+			t.Errorf("Get() = %+v, %v", u, err)
+		}
+
+		u, err = repo.Get(-1)
+		if err != nil || u != nil {
+			t.Errorf("Get(-1) = %+v, %v", u, err)
+		}
+
+		// 登録済みの場合は登録済みのユーザーを返す
+		u, err = repo.AddIfNotExist(&User{YahooId: "user1", Url: "http://example.com/other"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if u.Id != f.users[0].Id || u.Url != f.users[0].Url {
+			t.Errorf("AddIfNotExist() = %+v", u)
+		}
+	})
+}
+
+func TestUserRepoActive(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewUserRepo(tc)
+
+		u := &User{YahooId: "user4", Url: "http://example.com/user4", Active: true}
+		u.DisplayName.Scan("ユーザー4")
+		if err := repo.Add(u); err != nil {
+			t.Fatal(err)
+		}
+
+		f.users[2].Active = true
+		f.users[2].Url = "http://example.com/user3/new"
+		if err := repo.Update(&f.users[2]); err != nil {
+			t.Fatal(err)
+		}
+
+		users, err := repo.List(UserFilter{Active: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(users) != 2 || users[0].Id != f.users[2].Id || users[0].Url != "http://example.com/user3/new" || !users[0].Active || users[1].Id != u.Id || users[1].DisplayName.String != "ユーザー4" {
+			t.Errorf("List() = %+v", users)
+		}
+
+		got, err := repo.Get(f.users[0].Id)
+		if err != nil || got.Active {
+			t.Errorf("Get() = %+v, %v", got, err)
+		}
+	})
+}
+
+func TestBrandRepo(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewBrandRepo(tc)
+
+		bs, err := repo.List(BrandFilter{HasPosts: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(bs) != 2 || bs[0].Id != f.brands[0].Id || bs[0].NewPostCount != 1 || bs[1].Id != f.brands[1].Id {
+			t.Errorf("List() = %+v", bs)
+		}
+
+		// 投稿のない銘柄はどのDBでも最後
+		bs, err = repo.List(BrandFilter{Ids: []int{f.brands[2].Id, f.brands[1].Id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(bs) != 2 || bs[0].Id != f.brands[1].Id || bs[1].Id != f.brands[2].Id {
+			t.Errorf("List() = %+v", bs)
+		}
+
+		bs, err = repo.List(BrandFilter{Ids: []int{f.brands[2].Id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(bs) != 1 || !bs[0].PostTime.IsZero() {
+			t.Errorf("List() = %+v", bs)
+		}
+
+		brands, err := repo.GetByIds([]int{f.brands[1].Id, -1, f.brands[0].Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(brands) != 2 || brands[0].Id != f.brands[1].Id || brands[1].Id != f.brands[0].Id {
+			t.Errorf("GetByIds() = %+v", brands)
+		}
+
+		b, err := repo.GetByName("none")
+		if b != nil || err != nil {
+			t.Errorf("GetByName() = %v, %v", b, err)
+		}
+	})
+}
+
+func TestNotificationRepo(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewNotificationRepo(tc)
+
+		now := time.Now()
+		for i, b := range f.brands[:2] {
+			err := repo.AddBrand(&BrandNotification{BrandId: b.Id, PostTime: now.AddDate(0, 0, -3*i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := repo.DeleteBrandsBefore(now.AddDate(0, 0, -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, _ := tc.Tx.SelectInt("select count(*) from brand_notification")
+		if n != 1 {
+			t.Errorf("brand_notification count = %d, want 1", n)
+		}
+
+		err = repo.DeletePosts(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo.DeletePosts([]int{f.posts[0].Id, f.posts[1].Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, _ = tc.Tx.SelectInt("select count(*) from post_notification")
+		if n != 0 {
+			t.Errorf("post_notification count = %d, want 0", n)
+		}
+
+		deliveredAt := time.Date(2014, 6, 2, 9, 0, 0, 0, time.UTC)
+		ds := []NotificationDelivery{
+			{Channel: "slack", PostId: f.posts[0].Id, Status: DeliveryFailed, Attempts: 3, DeliveredAt: deliveredAt},
+			{Channel: "mail", PostId: f.posts[0].Id, Status: DeliverySent, Attempts: 1, DeliveredAt: deliveredAt},
+		}
+		ds[0].Error.Scan("503 Service Unavailable")
+
+		for i := range ds {
+			if err := repo.AddDelivery(&ds[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := repo.ListDeliveries(f.posts[0].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != 2 || got[0].Channel != "slack" || got[0].Error.String != "503 Service Unavailable" || got[1].Error.Valid || !got[1].DeliveredAt.Equal(deliveredAt) {
+			t.Errorf("ListDeliveries() = %+v", got)
+		}
+	})
+}
+
+func TestCrawlRepoWatermark(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewCrawlRepo(tc)
+
+		postTime := time.Date(2014, 6, 1, 10, 0, 0, 0, time.UTC)
+
+		// 2回目は更新になる
+		for _, no := range []string{"1", "2"} {
+			err := repo.SaveWatermark(&CrawlWatermark{UserId: f.users[0].Id, Url: "http://example.com/p" + no, CommentNo: no, PostTime: postTime})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = repo.SaveBoardWatermark(&BoardWatermark{BrandId: f.brands[1].Id, Url: "http://example.com/b" + no, CommentNo: no, PostTime: postTime})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		marks, err := repo.GetWatermarks()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w, ok := marks[f.users[0].Id]; len(marks) != 1 || !ok || w.CommentNo != "2" || w.Url != "http://example.com/p2" || !w.PostTime.Equal(postTime) {
+			t.Errorf("GetWatermarks() = %+v", marks)
+		}
+
+		boardMarks, err := repo.GetBoardWatermarks()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w, ok := boardMarks[f.brands[1].Id]; len(boardMarks) != 1 || !ok || w.CommentNo != "2" || w.Url != "http://example.com/b2" || !w.PostTime.Equal(postTime) {
+			t.Errorf("GetBoardWatermarks() = %+v", boardMarks)
+		}
+	})
+}
+
+func TestCrawlRepoState(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		repo := NewCrawlRepo(tc)
+		const key = "user/1"
+
+		cs, err := repo.GetState(key)
+		if err != nil || cs != nil {
+			t.Fatalf("GetState() = %+v, %v; want nil", cs, err)
+		}
+
+		for _, next := range []string{"http://example.com/user1?offset=10", "http://example.com/user1?offset=20"} {
+			err = repo.SaveState(&CrawlState{JobKey: key, Url: "http://example.com/user1", NextUrl: next, Posts: "[]"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cs, err = repo.GetState(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cs == nil || cs.Url != "http://example.com/user1" || cs.NextUrl != "http://example.com/user1?offset=20" || cs.Posts != "[]" || cs.UpdatedAt.IsZero() {
+			t.Fatalf("GetState() = %+v", cs)
+		}
+
+		// 別の取得方法の途中経過は残る
+		err = repo.SaveState(&CrawlState{JobKey: key + "/backfill", Url: "http://example.com/user1", NextUrl: "http://example.com/user1?offset=30", Posts: "[]"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = repo.DeleteState(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cs, err = repo.GetState(key)
+		if err != nil || cs != nil {
+			t.Errorf("GetState() after DeleteState = %+v, %v; want nil", cs, err)
+		}
+
+		if cs, _ = repo.GetState(key + "/backfill"); cs == nil {
+			t.Error("backfill state is deleted")
+		}
+	})
+}
+
+func TestWatchRuleRepo(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewWatchRuleRepo(tc)
+
+		now := time.Date(2014, 6, 2, 9, 0, 0, 0, time.UTC)
+		rules := []WatchRule{
+			{Name: "決算", Pattern: "決算", MatchType: MatchKeyword, Target: TargetAll, Enabled: true, CreatedAt: now, UpdatedAt: now},
+			{Name: "brand1", MatchType: MatchKeyword, Target: TargetAll, Enabled: false, CreatedAt: now, UpdatedAt: now},
+		}
+		rules[1].BrandId.Scan(int64(f.brands[0].Id))
+
+		for i := range rules {
+			if err := repo.Add(&rules[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := NewAlertRepo(tc).Add(&Alert{WatchRuleId: rules[1].Id, PostId: f.posts[0].Id, CreatedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+
+		vs, err := repo.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(vs) != 2 || vs[0].BrandName.Valid || vs[0].AlertCount != 0 || vs[1].BrandName.String != "brand1" || vs[1].Enabled || vs[1].AlertCount != 1 {
+			t.Errorf("List() = %+v", vs)
+		}
+
+		enabled, err := repo.ListEnabled()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(enabled) != 1 || enabled[0].Id != rules[0].Id || !enabled[0].CreatedAt.Equal(now) {
+			t.Errorf("ListEnabled() = %+v", enabled)
+		}
+
+		rules[1].Enabled = true
+		rules[1].Pattern = `\d+円`
+		rules[1].MatchType = MatchRegex
+		if err = repo.Update(&rules[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := repo.Get(rules[1].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got == nil || !got.Enabled || got.Pattern != `\d+円` || got.BrandId.Int64 != int64(f.brands[0].Id) {
+			t.Errorf("Get() = %+v", got)
+		}
+
+		got, err = repo.Get(-1)
+		if got != nil || err != nil {
+			t.Errorf("Get() = %v, %v", got, err)
+		}
+	})
+}
+
+func TestAlertRepo(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewAlertRepo(tc)
+
+		now := time.Date(2014, 6, 2, 9, 0, 0, 0, time.UTC)
+		rule := WatchRule{Name: "rule", Pattern: "t", MatchType: MatchKeyword, Target: TargetAll, Enabled: true, CreatedAt: now, UpdatedAt: now}
+		if err := NewWatchRuleRepo(tc).Add(&rule); err != nil {
+			t.Fatal(err)
+		}
+
+		alerts := make([]Alert, len(f.posts))
+		for i, p := range f.posts {
+			alerts[i] = Alert{WatchRuleId: rule.Id, PostId: p.Id, CreatedAt: now.Add(time.Duration(i) * time.Minute)}
+			if err := repo.Add(&alerts[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		n, err := repo.CountUnseen()
+		if err != nil || n != 3 {
+			t.Errorf("CountUnseen() = %d, %v", n, err)
+		}
+
+		total, vs, err := repo.List(AlertFilter{WatchRuleId: rule.Id, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if total != 3 || len(vs) != 2 || vs[0].Id != alerts[2].Id || vs[0].WatchRuleName != "rule" || vs[0].PostId != f.posts[2].Id || vs[0].UserYahooId != "user2" || vs[0].BrandName != "brand2" || vs[0].Seen {
+			t.Errorf("List() = %d, %+v", total, vs)
+		}
+
+		if err = repo.MarkSeen([]int{vs[0].Id, vs[1].Id}); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err = repo.CountUnseen()
+		if err != nil || n != 1 {
+			t.Errorf("CountUnseen() = %d, %v", n, err)
+		}
+
+		_, vs, err = repo.List(AlertFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(vs) != 3 || !vs[0].Seen || vs[2].Seen {
+			t.Errorf("List() = %+v", vs)
+		}
+
+		// 同じ条件で同じ投稿のアラートは作成できない
+		if err = repo.Add(&Alert{WatchRuleId: rule.Id, PostId: f.posts[0].Id, CreatedAt: now}); err == nil {
+			t.Error("Add() should fail")
+		}
+	})
+}
+
+func TestSearchRepo(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewSearchRepo(tc)
+
+		texts := [][2]string{
+			{"Quarterly results", "Revenue beat the forecast"},
+			{"Dividend", "The forecast was revised upward"},
+			{"Chart", "100% up, under_score"},
+		}
+
+		for i, text := range texts {
+			p := f.posts[i]
+			p.Title, p.Detail = text[0], text[1]
+			if _, err := NewPostRepo(tc).Save(&p); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			filter SearchFilter
+			total  int
+			ids    []int
+		}{
+			{SearchFilter{Query: "forecast"}, 2, []int{f.posts[1].Id, f.posts[0].Id}},
+			{SearchFilter{Query: "FORECAST revised"}, 1, []int{f.posts[1].Id}},
+			{SearchFilter{Query: "quarterly"}, 1, []int{f.posts[0].Id}},
+			{SearchFilter{Query: "forecast", Limit: 1, Offset: 1}, 2, []int{f.posts[0].Id}},
+			{SearchFilter{Query: "forecast", UserId: f.users[1].Id}, 0, nil},
+			{SearchFilter{Query: "forecast", From: f.posts[1].PostTime}, 1, []int{f.posts[1].Id}},
+			{SearchFilter{Query: "forecast", To: f.posts[1].PostTime}, 1, []int{f.posts[0].Id}},
+			{SearchFilter{BrandId: f.brands[1].Id}, 1, []int{f.posts[2].Id}},
+			{SearchFilter{Query: `"`}, 3, []int{f.posts[1].Id, f.posts[2].Id, f.posts[0].Id}},
+			{SearchFilter{Query: "nothing"}, 0, nil},
+		}
+
+		for _, tt := range tests {
+			total, posts, err := repo.Search(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := make([]int, 0, len(posts))
+			for _, p := range posts {
+				ids = append(ids, p.Id)
+			}
+
+			if total != tt.total || !equalInts(ids, tt.ids) {
+				t.Errorf("Search(%+v) = %d, %v, want %d, %v", tt.filter, total, ids, tt.total, tt.ids)
+			}
+		}
+
+		// 更新した投稿は更新後の内容で検索される
+		p := f.posts[0]
+		p.Detail = "No comment"
+		if _, err := NewPostRepo(tc).Save(&p); err != nil {
+			t.Fatal(err)
+		}
+
+		total, _, err := repo.Search(SearchFilter{Query: "revenue"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if total != 0 {
+			t.Errorf("Search(revenue) = %d, want 0", total)
+		}
+	})
+}
+
+func TestSearchRepoJapanese(t *testing.T) {
+	withTx(t, func(tc *TxContainer) {
+		f := addFixture(t, tc)
+		repo := NewSearchRepo(tc)
+
+		texts := [][2]string{
+			{"本日の決算発表", "増収増益でした"},
+			{"ｽﾄｯﾌﾟ高", "明日もストップ高になりそうです"},
+			{"ＮＩＳＡ", "すとっぷ安は避けたい"},
+		}
+
+		for i, text := range texts {
+			p := f.posts[i]
+			p.Title, p.Detail = text[0], text[1]
+			if _, err := NewPostRepo(tc).Save(&p); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			query string
+			ids   []int
+		}{
+			{"決算", []int{f.posts[0].Id}},
+			{"算", []int{f.posts[0].Id}},
+			{"ストップ高", []int{f.posts[1].Id}},
+			{"すとっぷ", []int{f.posts[1].Id, f.posts[2].Id}},
+			{"ｽﾄｯﾌﾟ 安", []int{f.posts[2].Id}},
+			{"nisa", []int{f.posts[2].Id}},
+			{"決算　増益", []int{f.posts[0].Id}},
+			{"発表増収", nil},
+			{"!!", []int{f.posts[1].Id, f.posts[2].Id, f.posts[0].Id}},
+		}
+
+		for _, tt := range tests {
+			_, posts, err := repo.Search(SearchFilter{Query: tt.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := make([]int, 0, len(posts))
+			for _, p := range posts {
+				ids = append(ids, p.Id)
+			}
+
+			if !equalInts(ids, tt.ids) {
+				t.Errorf("Search(%q) = %v, want %v", tt.query, ids, tt.ids)
+			}
+		}
+	})
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"../tokenizer"
+)
+
+// SearchFilter はSearchRepo.Searchの条件。0やゼロ値の項目では絞り込まない
+type SearchFilter struct {
+	// 空白で区切った語を全て含む投稿を検索する
+	Query   string
+	UserId  int
+	BrandId int
+	// Fromから、Toの前までに投稿されたもの
+	From time.Time
+	To   time.Time
+	// 0の場合は全件
+	Limit  int
+	Offset int
+}
+
+// Terms はQueryを空白で区切った語。"は検索には使わない
+func (f SearchFilter) Terms() []string {
+	return strings.Fields(strings.Replace(f.Query, `"`, "", -1))
+}
+
+// SearchRepo は投稿のタイトルと本文の全文検索
+//
+// 索引も検索語もtokenizerで正規化するので、全角と半角、ひらがなとカタカナ、大文字と小文字を区別しない
+// sqlite3はFTS4にn-gramを登録し、他のDBは正規化した本文をpost_searchに持ってlikeで検索する
+type SearchRepo struct {
+	tc *TxContainer
+}
+
+func NewSearchRepo(tc *TxContainer) *SearchRepo {
+	return &SearchRepo{tc: tc}
+}
+
+// Search は該当する件数と、投稿日時の新しい順にLimit件の投稿を返す
+func (r *SearchRepo) Search(f SearchFilter) (int, []PostView, error) {
+	where := make([]string, 0, 5)
+	args := make([]interface{}, 0, 8)
+
+	if terms := f.Terms(); len(terms) > 0 {
+		// 記号だけの語は索引にないので条件にしない
+		if r.tc.d.IsSQLite() {
+			if q := matchQuery(terms); q != "" {
+				where = append(where, "A.id in (select docid from post_fts where post_fts match ?)")
+				args = append(args, q)
+			}
+		} else {
+			// FTSと同じように、語を文字と数字が続く部分ごとに分けて全てを含むものを検索する
+			for _, term := range terms {
+				for _, seg := range tokenizer.Segments(term) {
+					where = append(where, `A.id in (select "post_id" from "post_search" where "body" like ? escape '!')`)
+					args = append(args, "%"+escapeLike(seg)+"%")
+				}
+			}
+		}
+	}
+
+	if f.UserId != 0 {
+		where = append(where, "A.user_id=?")
+		args = append(args, f.UserId)
+	}
+
+	if f.BrandId != 0 {
+		where = append(where, "A.brand_id=?")
+		args = append(args, f.BrandId)
+	}
+
+	if !f.From.IsZero() {
+		where = append(where, "A.post_time>=?")
+		args = append(args, ToDbTime(f.From))
+	}
+
+	if !f.To.IsZero() {
+		where = append(where, "A.post_time<?")
+		args = append(args, ToDbTime(f.To))
+	}
+
+	return NewPostRepo(r.tc).list(where, args, f.Limit, f.Offset)
+}
+
+// Index は投稿を索引に追加する。更新された場合は索引も更新する
+// 索引の形式はmigrationsのreindexPostsと同じにすること
+func (r *SearchRepo) Index(p *Post) error {
+	var err error
+
+	if r.tc.d.IsSQLite() {
+		_, err = r.tc.Tx.Exec("delete from post_fts where docid=?", p.Id)
+		if err == nil {
+			_, err = r.tc.Tx.Exec("insert into post_fts (docid, title, detail) values (?, ?, ?)",
+				p.Id, tokenizer.IndexText(p.Title), tokenizer.IndexText(p.Detail))
+		}
+	} else {
+		_, err = r.tc.Tx.Exec(`delete from "post_search" where "post_id"=?`, p.Id)
+		if err == nil {
+			_, err = r.tc.Tx.Exec(`insert into "post_search" ("post_id", "body") values (?, ?)`,
+				p.Id, tokenizer.Normalize(p.Title+"\n"+p.Detail))
+		}
+	}
+
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// 各語をn-gramのフレーズにして、全てを含むものを検索する
+// 1文字の部分はその文字で始まる語に前方一致させる
+func matchQuery(terms []string) string {
+	phrases := make([]string, 0, len(terms))
+	for _, term := range terms {
+		for _, tokens := range tokenizer.QueryPhrases(term) {
+			if len(tokens) == 1 && utf8.RuneCountInString(tokens[0]) == 1 {
+				phrases = append(phrases, tokens[0]+"*")
+				continue
+			}
+
+			phrases = append(phrases, `"`+strings.Join(tokens, " ")+`"`)
+		}
+	}
+
+	return strings.Join(phrases, " ")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
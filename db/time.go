@@ -0,0 +1,83 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// 日時はタイムゾーンに関係なく比較、集計できるように、全てUTCのこの形式で保存する
+const TIME_FORMAT = "2006-01-02 15:04:05"
+
+// 以前のドライバで保存された、タイムゾーン付きの形式も読めるようにする
+var timeFormats = []string{
+	TIME_FORMAT,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05Z07:00",
+}
+
+// ToDbTime はクエリのパラメータに日時を渡す場合に使う
+// (Insert、Updateの場合はtimeConverterで変換される)
+func ToDbTime(t time.Time) string {
+	return t.UTC().Format(TIME_FORMAT)
+}
+
+// ParseDbTime はDBに保存された日時をUTCのtime.Timeにする
+func ParseDbTime(s string) (time.Time, error) {
+	for _, f := range timeFormats {
+		t, err := time.ParseInLocation(f, s, time.UTC)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%s を time.Timeに変換できません。", s)
+}
+
+func scanDbTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return t.UTC(), nil
+	case []byte:
+		return ParseDbTime(string(t))
+	case string:
+		return ParseDbTime(t)
+	default:
+		return time.Time{}, fmt.Errorf("%v を time.Timeに変換できません。", v)
+	}
+}
+
+type timeConverter struct {
+}
+
+func (c timeConverter) ToDb(val interface{}) (interface{}, error) {
+	if t, ok := val.(time.Time); ok {
+		return ToDbTime(t), nil
+	}
+
+	return val, nil
+}
+
+func (c timeConverter) FromDb(target interface{}) (gorp.CustomScanner, bool) {
+	if _, ok := target.(*time.Time); !ok {
+		return gorp.CustomScanner{}, false
+	}
+
+	binder := func(holder, target interface{}) error {
+		t, err := scanDbTime(*holder.(*interface{}))
+		if err != nil {
+			return err
+		}
+
+		*target.(*time.Time) = t
+
+		return nil
+	}
+
+	return gorp.CustomScanner{Holder: new(interface{}), Target: target, Binder: binder}, true
+}
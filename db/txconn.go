@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+)
+
+// gorpのBeginはsql.TxOptionsを渡せないので、DoContextはトランザクションの設定をctxに入れ、
+// 接続のBeginTxでドライバに渡す(mysqlとpostgresのドライバはReadOnlyと分離レベルに対応している)
+type txOptionsKey struct{}
+
+func withTxOptions(ctx context.Context, opts *TxOptions) context.Context {
+	return context.WithValue(ctx, txOptionsKey{}, driver.TxOptions{
+		Isolation: driver.IsolationLevel(opts.Isolation),
+		ReadOnly:  opts.ReadOnly,
+	})
+}
+
+// openDb はsqlite3以外の場合、ctxのトランザクションの設定をドライバに渡す接続でDBを開く
+// sqlite3は分離レベルを変更できず、読み込み専用は接続のquery_onlyで設定する(beginTx)
+func openDb(driverName string, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil || driverName == "sqlite3" {
+		return db, err
+	}
+
+	dc, ok := db.Driver().(driver.DriverContext)
+	db.Close()
+	if !ok {
+		return nil, fmt.Errorf("driver %s does not support connectors", driverName)
+	}
+
+	connector, err := dc.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return sql.OpenDB(&txConnector{Connector: connector}), nil
+}
+
+type txConnector struct {
+	driver.Connector
+}
+
+func (c *txConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &txConn{Conn: conn}, nil
+}
+
+// txConn はBeginTx以外はドライバの接続にそのまま委譲する
+// 任意のインターフェースもdatabase/sqlが元の接続と同じように使えるように全て実装する
+type txConn struct {
+	driver.Conn
+}
+
+func (c *txConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if o, ok := ctx.Value(txOptionsKey{}).(driver.TxOptions); ok {
+		opts = o
+	}
+
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+
+	if opts.ReadOnly || opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		return nil, fmt.Errorf("driver does not support transaction options")
+	}
+
+	return c.Conn.Begin()
+}
+
+func (c *txConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+
+	return c.Conn.Prepare(query)
+}
+
+func (c *txConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+
+	return nil, driver.ErrSkip
+}
+
+func (c *txConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+
+	return nil, driver.ErrSkip
+}
+
+func (c *txConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *txConn) CheckNamedValue(v *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(v)
+	}
+
+	return driver.ErrSkip
+}
+
+func (c *txConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *txConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+
+	return true
+}
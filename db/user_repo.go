@@ -0,0 +1,154 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+)
+
+type UserOrder int
+
+const (
+	UserOrderById UserOrder = iota
+	// 最後の投稿が新しい順
+	UserOrderByLastPost
+)
+
+// UserFilter はUserRepo.Listの絞り込み条件
+type UserFilter struct {
+	// 空でない場合はYahoo IDで絞り込む
+	YahooIds []string
+	// trueの場合は投稿のあるユーザーのみ
+	HasPosts bool
+	// trueの場合はバッチで取得するユーザーのみ
+	Active bool
+	Order  UserOrder
+}
+
+type UserRepo struct {
+	tc *TxContainer
+}
+
+func NewUserRepo(tc *TxContainer) *UserRepo {
+	return &UserRepo{tc: tc}
+}
+
+// List はユーザーと最後の投稿日時、未読の投稿数を返す
+func (r *UserRepo) List(f UserFilter) ([]UserPostTimeView, error) {
+	var users []UserPostTimeView
+
+	where := make([]string, 0, 2)
+	args := make([]interface{}, 0, len(f.YahooIds))
+
+	if len(f.YahooIds) > 0 {
+		where = append(where, "A.yahoo_id in ("+placeholders(len(f.YahooIds))+")")
+		for _, id := range f.YahooIds {
+			args = append(args, id)
+		}
+	}
+
+	if f.HasPosts {
+		where = append(where, "B.user_id is not null")
+	}
+
+	if f.Active {
+		where = append(where, "A.active=?")
+		args = append(args, true)
+	}
+
+	sql := `select A.id as Id, A.yahoo_id as YahooId, A.display_name as DisplayName, A.url as Url, A.active as Active, B.post_time as PostTime, coalesce(B.new_post_count, 0) as NewPostCount from "user" A left join (select user_id, max(post_time) as post_time, count(B1.post_id) as new_post_count from post A1 left join post_notification B1 on A1.id = B1.post_id group by user_id) B on A.id = B.user_id`
+	if len(where) > 0 {
+		sql += " where " + strings.Join(where, " and ")
+	}
+
+	switch f.Order {
+	case UserOrderByLastPost:
+		// nullの順序はDBによって違うので、投稿のないユーザーを明示的に最後にする
+		sql += " order by B.post_time is null, B.post_time desc, A.id asc"
+	default:
+		sql += " order by A.id asc"
+	}
+
+	_, err := r.tc.Tx.Select(&users, sql, args...)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Get は該当するユーザーがいない場合nilを返す
+func (r *UserRepo) Get(id int) (*User, error) {
+	obj, err := r.tc.Tx.Get(User{}, id)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	if obj == nil {
+		return nil, nil
+	}
+
+	return obj.(*User), nil
+}
+
+// GetByYahooId は該当するユーザーがいない場合nilを返す
+func (r *UserRepo) GetByYahooId(yahooId string) (*User, error) {
+	var u User
+	err := r.tc.Tx.SelectOne(&u, `select * from "user" where yahoo_id=?`, yahooId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// AddIfNotExist は同じYahoo IDのユーザーが登録済みの場合、登録済みのユーザーを返す
+func (r *UserRepo) AddIfNotExist(u *User) (*User, error) {
+	exist, err := r.GetByYahooId(u.YahooId)
+	if err != nil {
+		return nil, err
+	}
+
+	if exist != nil {
+		return exist, nil
+	}
+
+	err = r.tc.Tx.Insert(u)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (r *UserRepo) Add(u *User) error {
+	err := r.tc.Tx.Insert(u)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *UserRepo) Update(u *User) error {
+	_, err := r.tc.Tx.Update(u)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"log"
+)
+
+// WatchRuleRepo は投稿の監視条件を管理する
+type WatchRuleRepo struct {
+	tc *TxContainer
+}
+
+func NewWatchRuleRepo(tc *TxContainer) *WatchRuleRepo {
+	return &WatchRuleRepo{tc: tc}
+}
+
+// List は無効なものも含めた全ての監視条件をID順に返す
+func (r *WatchRuleRepo) List() ([]WatchRuleView, error) {
+	var rules []WatchRuleView
+
+	sql := `select A.id as Id, A.name as Name, A.pattern as Pattern, A.match_type as MatchType, A.target as Target, A.user_id as UserId, A.brand_id as BrandId, A.enabled as Enabled, A.created_at as CreatedAt, A.updated_at as UpdatedAt, B.yahoo_id as UserYahooId, B.display_name as UserDisplayName, C.brand_name as BrandName, coalesce(D.alert_count, 0) as AlertCount from watch_rule A left join "user" B on A.user_id = B.id left join brand C on A.brand_id = C.id left join (select watch_rule_id, count(*) as alert_count from alert group by watch_rule_id) D on A.id = D.watch_rule_id order by A.id asc`
+
+	_, err := r.tc.Tx.Select(&rules, sql)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// ListEnabled は有効な監視条件をID順に返す
+func (r *WatchRuleRepo) ListEnabled() ([]WatchRule, error) {
+	var rules []WatchRule
+	_, err := r.tc.Tx.Select(&rules, "select * from watch_rule where enabled=? order by id", true)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// Get は該当する監視条件がない場合nilを返す
+func (r *WatchRuleRepo) Get(id int) (*WatchRule, error) {
+	obj, err := r.tc.Tx.Get(WatchRule{}, id)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return nil, err
+	}
+
+	if obj == nil {
+		return nil, nil
+	}
+
+	return obj.(*WatchRule), nil
+}
+
+func (r *WatchRuleRepo) Add(w *WatchRule) error {
+	err := r.tc.Tx.Insert(w)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *WatchRuleRepo) Update(w *WatchRule) error {
+	_, err := r.tc.Tx.Update(w)
+	if err != nil {
+		r.tc.Err = err
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"../db"
+	"../migrations"
+	"../util"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: migrate up [version] | down [steps] | status")
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	util.LoadConfig()
+
+	// 開くときには適用せず、コマンドで指定したとおりに適用する
+	util.Cfg.AutoMigrate = false
+
+	if err := db.Open(); err != nil {
+		log.Fatalln(err)
+	}
+
+	conn, d, err := db.SqlDB()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	switch flag.Arg(0) {
+	case "up":
+		err = migrations.Up(conn, d, intArg(1, 0))
+	case "down":
+		err = migrations.Down(conn, d, intArg(1, 1))
+	case "status":
+		err = printStatus(conn, d)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db.Close()
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func intArg(i int, def int) int {
+	if flag.NArg() <= i {
+		return def
+	}
+
+	n, err := strconv.Atoi(flag.Arg(i))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return n
+}
+
+func printStatus(conn *sql.DB, d *migrations.Dialect) error {
+	list, err := migrations.Status(conn, d)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range list {
+		if s.Applied {
+			fmt.Printf("%3d  applied %s  %s\n", s.Version, s.AppliedAt.In(util.DisplayLocation).Format("2006/01/02 15:04:05"), s.Name)
+		} else {
+			fmt.Printf("%3d  pending                      %s\n", s.Version, s.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package migrations
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Dialect はDBごとのSQLの違い
+//
+// マイグレーションのSQLはtext/templateで、Dialectの値を埋め込んで実行する
+// クエリはsqlite3に合わせて?と"で書き、Rebindで各DBの書き方に変換する
+type Dialect struct {
+	// sql.Openに渡すドライバ名と同じ
+	Name         string
+	Serial       string
+	Datetime     string
+	Text         string
+	TableOptions string
+}
+
+var dialects = map[string]*Dialect{
+	"sqlite3": {
+		Name:     "sqlite3",
+		Serial:   "integer not null primary key autoincrement",
+		Datetime: "datetime",
+		Text:     "text",
+	},
+	"postgres": {
+		Name:     "postgres",
+		Serial:   "serial primary key",
+		Datetime: "timestamp",
+		Text:     "text",
+	},
+	"mysql": {
+		Name:         "mysql",
+		Serial:       "integer not null primary key auto_increment",
+		Datetime:     "datetime",
+		Text:         "longtext",
+		TableOptions: " engine=InnoDB default charset=utf8mb4",
+	},
+}
+
+// GetDialect は名前が空の場合sqlite3を返す
+func GetDialect(name string) (*Dialect, error) {
+	if name == "" {
+		name = "sqlite3"
+	}
+
+	d, ok := dialects[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown dialect : %s", name)
+	}
+
+	return d, nil
+}
+
+func (d *Dialect) IsSQLite() bool {
+	return d.Name == "sqlite3"
+}
+
+func (d *Dialect) IsMySQL() bool {
+	return d.Name == "mysql"
+}
+
+// Rebind はpostgresの場合?を$1、$2...に、mysqlの場合"を`に置き換える
+// 文字列リテラルの中は置き換えない
+func (d *Dialect) Rebind(query string) string {
+	if d.Name == "sqlite3" {
+		return query
+	}
+
+	var buf bytes.Buffer
+	n := 0
+	quoted := false
+
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '?' && d.Name == "postgres":
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		case c == '"' && d.Name == "mysql":
+			buf.WriteRune('`')
+			continue
+		}
+
+		buf.WriteRune(c)
+	}
+
+	return buf.String()
+}
+
+func (d *Dialect) expand(stmt string) (string, error) {
+	t, err := template.New("").Parse(stmt)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, d)
+	if err != nil {
+		return "", err
+	}
+
+	return d.Rebind(strings.TrimSpace(buf.String())), nil
+}
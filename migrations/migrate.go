@@ -0,0 +1,224 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Migration は番号付きのスキーマの変更
+// Upの各文を順に実行して適用し、Downの各文を順に実行して元に戻す
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	// SQLだけでは書けないデータの変更。Upの後に同じトランザクションで実行する
+	UpFunc func(tx *sql.Tx, d *Dialect) error
+	Down   []string
+}
+
+// VersionStatus はマイグレーションごとの適用状況
+type VersionStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+const createVersionTable = `create table if not exists schema_version (version integer not null primary key, name varchar(255) not null, applied_at {{.Datetime}} not null){{.TableOptions}}`
+
+const appliedAtFormat = "2006-01-02 15:04:05"
+
+func createVersionTableIfNotExists(db *sql.DB, d *Dialect) error {
+	stmt, err := d.expand(createVersionTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(stmt)
+
+	return err
+}
+
+// Current は適用済みの最新のバージョン。何も適用されていない場合は0
+func Current(db *sql.DB, d *Dialect) (int, error) {
+	err := createVersionTableIfNotExists(db, d)
+	if err != nil {
+		return 0, err
+	}
+
+	var v sql.NullInt64
+	err = db.QueryRow("select max(version) from schema_version").Scan(&v)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(v.Int64), nil
+}
+
+// Latest はAllの最新のバージョン
+func Latest() int {
+	if len(All) == 0 {
+		return 0
+	}
+
+	return All[len(All)-1].Version
+}
+
+// Status は各マイグレーションの適用状況
+func Status(db *sql.DB, d *Dialect) ([]VersionStatus, error) {
+	err := createVersionTableIfNotExists(db, d)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("select version, applied_at from schema_version")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var v int
+		var at interface{}
+		err = rows.Scan(&v, &at)
+		if err != nil {
+			return nil, err
+		}
+
+		applied[v], err = scanTime(at)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]VersionStatus, len(All))
+	for i, m := range All {
+		at, ok := applied[m.Version]
+		list[i] = VersionStatus{Migration: m, Applied: ok, AppliedAt: at}
+	}
+
+	return list, nil
+}
+
+// Up はtargetのバージョンまで適用する。targetが0の場合は最新まで適用する
+func Up(db *sql.DB, d *Dialect, target int) error {
+	if target == 0 {
+		target = Latest()
+	}
+
+	current, err := Current(db, d)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range All {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+
+		log.Printf("migrate up : %d %s", m.Version, m.Name)
+
+		err = apply(db, d, m.Up, func(tx *sql.Tx) error {
+			if m.UpFunc != nil {
+				if err := m.UpFunc(tx, d); err != nil {
+					return err
+				}
+			}
+
+			_, err := tx.Exec(d.Rebind("insert into schema_version (version, name, applied_at) values (?, ?, ?)"),
+				m.Version, m.Name, time.Now().UTC().Format(appliedAtFormat))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d : %v", m.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// Down は適用済みのものを新しい方からsteps個戻す
+func Down(db *sql.DB, d *Dialect, steps int) error {
+	current, err := Current(db, d)
+	if err != nil {
+		return err
+	}
+
+	for i := len(All) - 1; i >= 0 && steps > 0; i-- {
+		m := All[i]
+		if m.Version > current {
+			continue
+		}
+
+		log.Printf("migrate down : %d %s", m.Version, m.Name)
+
+		err = apply(db, d, m.Down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(d.Rebind("delete from schema_version where version=?"), m.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d : %v", m.Version, err)
+		}
+
+		steps--
+	}
+
+	return nil
+}
+
+// mysqlではDDLは暗黙的にコミットされるので、途中で失敗した場合は手動で戻す必要がある
+func apply(db *sql.DB, d *Dialect, stmts []string, record func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range stmts {
+		stmt, err = d.expand(stmt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// DBによっては不要な文は空になる
+		if stmt == "" {
+			continue
+		}
+
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = record(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ドライバによってtime.Time、[]byte、stringのいずれかになる
+func scanTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t.UTC(), nil
+	case []byte:
+		return time.ParseInLocation(appliedAtFormat, string(t), time.UTC)
+	case string:
+		return time.ParseInLocation(appliedAtFormat, t, time.UTC)
+	default:
+		return time.Time{}, fmt.Errorf("%v を time.Timeに変換できません。", v)
+	}
+}
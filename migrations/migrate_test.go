@@ -0,0 +1,401 @@
+package migrations
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TEST_DB_DIALECTとTEST_DB_DSNを指定した場合はそのDBでテストする
+// テーブルを作成、削除するので、テスト専用の空のDBを指定すること
+func openDb(t *testing.T) (*sql.DB, *Dialect) {
+	d, err := GetDialect(os.Getenv("TEST_DB_DIALECT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsn := os.Getenv("TEST_DB_DSN")
+	if d.Name == "sqlite3" && dsn == "" {
+		dsn = ":memory:"
+	}
+
+	db, err := sql.Open(d.Name, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// :memory:は接続ごとに別のDBになる
+	db.SetMaxOpenConns(1)
+
+	return db, d
+}
+
+// 全て戻してから閉じる
+func closeDb(t *testing.T, db *sql.DB, d *Dialect) {
+	err := Down(db, d, len(All))
+	if err != nil {
+		t.Error(err)
+	}
+
+	db.Close()
+}
+
+func tableExists(db *sql.DB, d *Dialect, name string) bool {
+	rows, err := db.Query(d.Rebind(`select 1 from "` + name + `" where 1=0`))
+	if err != nil {
+		return false
+	}
+
+	rows.Close()
+
+	return true
+}
+
+func TestUpDown(t *testing.T) {
+	db, d := openDb(t)
+	defer closeDb(t, db, d)
+
+	err := Up(db, d, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := Current(db, d); v != 3 {
+		t.Fatalf("Current() = %d, want 3", v)
+	}
+
+	if !tableExists(db, d, "crawl_watermark") || tableExists(db, d, "board_watermark") {
+		t.Fatal("version 3 tables are not created as expected")
+	}
+
+	err = Up(db, d, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := Current(db, d); v != Latest() {
+		t.Fatalf("Current() = %d, want %d", v, Latest())
+	}
+
+	err = Down(db, d, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := Current(db, d); v != Latest()-2 {
+		t.Fatalf("Current() = %d, want %d", v, Latest()-2)
+	}
+
+	list, err := Status(db, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range list {
+		if s.Applied != (s.Version <= Latest()-2) {
+			t.Errorf("version %d applied = %v", s.Version, s.Applied)
+		}
+
+		if s.Applied && s.AppliedAt.IsZero() {
+			t.Errorf("version %d applied_at is zero", s.Version)
+		}
+	}
+
+	err = Down(db, d, len(All))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tableExists(db, d, "post") {
+		t.Error("post is not dropped")
+	}
+}
+
+// CreateTablesIfNotExistsで作成されたDBに重複した投稿がある場合
+func TestUpExistingDb(t *testing.T) {
+	db, d := openDb(t)
+	defer closeDb(t, db, d)
+
+	// 1と3が同じURL。最初の1を残し、削除する3の未読だけを消す
+	stmts := append([]string{}, All[0].Up...)
+	stmts = append(stmts,
+		`insert into post (user_id, brand_id, comment_no, title, url, detail) values (1, 1, '1', 't', 'http://example.com/1', 'd')`,
+		`insert into post (user_id, brand_id, comment_no, title, url, detail) values (1, 1, '2', 't', 'http://example.com/2', 'd')`,
+		`insert into post (user_id, brand_id, comment_no, title, url, detail) values (1, 1, '1', 't', 'http://example.com/1', 'd')`,
+		`insert into post_notification (post_id) select max(id) from post`,
+		`insert into post_notification (post_id) select min(id) from post`,
+	)
+	for _, stmt := range stmts {
+		stmt, err := d.expand(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := Up(db, d, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(d.Rebind(`select comment_no from post order by id`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nos []string
+	for rows.Next() {
+		var no string
+		rows.Scan(&no)
+		nos = append(nos, no)
+	}
+	rows.Close()
+
+	if len(nos) != 2 || nos[0] != "1" || nos[1] != "2" {
+		t.Errorf("posts = %v, want [1 2]", nos)
+	}
+
+	var n, min int
+	db.QueryRow("select count(*) from post_notification").Scan(&n)
+	db.QueryRow("select min(id) from post").Scan(&min)
+	var notified int
+	db.QueryRow("select post_id from post_notification").Scan(&notified)
+	if n != 1 || notified != min {
+		t.Errorf("post_notification = %d rows (post %d), want 1 row (post %d)", n, notified, min)
+	}
+
+	// 一意制約で同じURLの投稿は追加できない
+	_, err = db.Exec(`insert into post (user_id, brand_id, comment_no, title, url, detail) values (1, 1, '1', 't', 'http://example.com/1', 'd')`)
+	if err == nil {
+		t.Error("duplicate post is inserted")
+	}
+}
+
+// 途中で失敗したマイグレーションは適用済みにならない
+func TestUpRollback(t *testing.T) {
+	db, d := openDb(t)
+	defer closeDb(t, db, d)
+
+	if d.IsMySQL() {
+		t.Skip("DDL is not transactional in mysql")
+	}
+
+	saved := All
+	defer func() { All = saved }()
+
+	All = append(append([]Migration{}, saved...), Migration{
+		Version: Latest() + 1,
+		Name:    "broken",
+		Up:      []string{`create table broken (id integer)`, `syntax error`},
+		Down:    []string{`drop table broken`},
+	})
+
+	err := Up(db, d, 0)
+	if err == nil {
+		t.Fatal("Up() returned nil")
+	}
+
+	if v, _ := Current(db, d); v != saved[len(saved)-1].Version {
+		t.Errorf("Current() = %d, want %d", v, saved[len(saved)-1].Version)
+	}
+
+	if tableExists(db, d, "broken") {
+		t.Error("broken table is not rolled back")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect string
+		in      string
+		want    string
+	}{
+		{"sqlite3", `select * from "user" where id=? and name='?'`, `select * from "user" where id=? and name='?'`},
+		{"postgres", `select * from "user" where id=? and name='?' and url=?`, `select * from "user" where id=$1 and name='?' and url=$2`},
+		{"mysql", `select * from "user" where id=? and name='"'`, "select * from `user` where id=? and name='\"'"},
+	}
+
+	for _, tt := range tests {
+		d, err := GetDialect(tt.dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := d.Rebind(tt.in); got != tt.want {
+			t.Errorf("%s Rebind(%q) = %q, want %q", tt.dialect, tt.in, got, tt.want)
+		}
+	}
+}
+
+// sqlite3だけに対応していた頃のマイグレーションは、sqlite3で実行するSQLが当時と同じであること
+func TestSQLiteUnchanged(t *testing.T) {
+	want := map[int][]string{
+		1: {
+			`create table if not exists "user" ("id" integer not null primary key autoincrement, "yahoo_id" varchar(255) not null, "display_name" varchar(255), "url" varchar(255) not null)`,
+			`create table if not exists "brand" ("id" integer not null primary key autoincrement, "brand_name" varchar(255) not null, "url" varchar(255) not null)`,
+			`create table if not exists "post" ("id" integer not null primary key autoincrement, "user_id" integer not null, "brand_id" integer not null, "comment_no" varchar(255) not null, "title" varchar(255) not null, "url" varchar(255) not null, "ref_no" varchar(255), "ref_url" varchar(255), "detail" varchar(10000) not null, "post_time" datetime)`,
+			`create table if not exists "brand_notification" ("brand_id" integer not null primary key, "post_time" datetime)`,
+			`create table if not exists "post_notification" ("post_id" integer not null primary key)`,
+			`drop table "post_notification"`,
+			`drop table "brand_notification"`,
+			`drop table "post"`,
+			`drop table "brand"`,
+			`drop table "user"`,
+		},
+		2: {
+			`delete from post_notification where post_id not in (select min(id) from post group by url)`,
+			`delete from post where id not in (select min(id) from post group by url)`,
+			`create unique index if not exists post_url on post(url)`,
+			`drop index post_url`,
+		},
+		3: {
+			`create table if not exists "crawl_watermark" ("user_id" integer not null primary key, "url" varchar(255) not null, "comment_no" varchar(255) not null, "post_time" datetime)`,
+			`drop table "crawl_watermark"`,
+		},
+		4: {
+			`create table if not exists "board_watermark" ("brand_id" integer not null primary key, "url" varchar(255) not null, "comment_no" varchar(255) not null, "post_time" datetime)`,
+			`drop table "board_watermark"`,
+		},
+		5: {
+			`create table if not exists "crawl_state" ("url" varchar(255) not null primary key, "next_url" varchar(255) not null, "posts" text not null, "updated_at" datetime)`,
+			`drop table "crawl_state"`,
+		},
+	}
+
+	d, _ := GetDialect("sqlite3")
+
+	for _, m := range All {
+		stmts, ok := want[m.Version]
+		if !ok {
+			continue
+		}
+
+		got := make([]string, 0, len(stmts))
+		for _, stmt := range append(append([]string{}, m.Up...), m.Down...) {
+			s, err := d.expand(stmt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got = append(got, s)
+		}
+
+		if len(got) != len(stmts) {
+			t.Errorf("version %d: %d statements, want %d", m.Version, len(got), len(stmts))
+			continue
+		}
+
+		for i := range stmts {
+			if got[i] != stmts[i] {
+				t.Errorf("version %d:\n got %s\nwant %s", m.Version, got[i], stmts[i])
+			}
+		}
+	}
+}
+
+// users.jsonに指定されていたユーザーは、取得位置が保存されていなくても取得対象になる
+func TestActivateUsers(t *testing.T) {
+	db, d := openDb(t)
+	defer closeDb(t, db, d)
+
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := UsersJsonFile
+	defer func() { UsersJsonFile = saved }()
+
+	usersJson := filepath.Join(dir, "users.json")
+	err = ioutil.WriteFile(usersJson, []byte(`[{"Id" : 1, "YahooId" : "tracked", "Url" : ""}, {"Id" : 2, "YahooId" : "never_crawled", "Url" : ""}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Up(db, d, 9); err != nil {
+		t.Fatal(err)
+	}
+
+	// trackedは取得位置あり、never_crawledは取得位置なし、authorは掲示板の取得で追加されたユーザー
+	for _, stmt := range []string{
+		`insert into "user" ("yahoo_id", "url") values ('tracked', 'http://example.com/tracked')`,
+		`insert into "user" ("yahoo_id", "url") values ('never_crawled', 'http://example.com/never_crawled')`,
+		`insert into "user" ("yahoo_id", "url") values ('author', 'http://example.com/author')`,
+		`insert into "crawl_watermark" ("user_id", "url", "comment_no") select "id", 'http://example.com/1', '1' from "user" where "yahoo_id"='tracked'`,
+	} {
+		if _, err = db.Exec(d.Rebind(stmt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file   string
+		boards bool
+		want   string
+	}{
+		{usersJson, false, "tracked,never_crawled"},
+		// users.jsonがなく、掲示板を取得したことがなければ全員
+		{filepath.Join(dir, "notexist.json"), false, "tracked,never_crawled,author"},
+		{"", false, "tracked,never_crawled,author"},
+		{usersJson, true, "tracked,never_crawled"},
+	}
+
+	for _, tt := range tests {
+		UsersJsonFile = tt.file
+
+		if tt.boards {
+			if _, err = db.Exec(d.Rebind(`insert into "board_watermark" ("brand_id", "url", "comment_no") values (1, 'http://example.com/b1', '1')`)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = Up(db, d, 10); err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.Query(d.Rebind(`select "yahoo_id" from "user" where "active"=? order by "id"`), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for rows.Next() {
+			var id string
+			rows.Scan(&id)
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		if got := strings.Join(ids, ","); got != tt.want {
+			t.Errorf("%s (boards %v): active users = %s, want %s", filepath.Base(tt.file), tt.boards, got, tt.want)
+		}
+
+		if err = Down(db, d, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 掲示板の取得で追加されたユーザーと区別できない場合は推測せずに失敗する
+	for _, file := range []string{"", filepath.Join(dir, "notexist.json")} {
+		UsersJsonFile = file
+
+		if err = Up(db, d, 10); err == nil {
+			t.Errorf("%q: Up() should fail without users.json", file)
+		}
+
+		if v, _ := Current(db, d); v != 9 {
+			t.Errorf("%q: version = %d, want 9", file, v)
+		}
+	}
+}
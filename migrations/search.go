@@ -0,0 +1,65 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"../tokenizer"
+)
+
+const reindexBatchSize = 1000
+
+// reindexPosts は全ての投稿を検索の索引に登録し直す
+// 索引の形式はdb.SearchRepo.Indexと同じにすること
+func reindexPosts(tx *sql.Tx, d *Dialect) error {
+	type post struct {
+		id     int
+		title  string
+		detail string
+	}
+
+	lastId := 0
+
+	for {
+		rows, err := tx.Query(d.Rebind(`select "id", "title", "detail" from "post" where "id">? order by "id" limit ?`), lastId, reindexBatchSize)
+		if err != nil {
+			return err
+		}
+
+		// mysqlでは結果を読み終えるまで次の文を実行できないので、先に全て読む
+		posts := make([]post, 0, reindexBatchSize)
+		for rows.Next() {
+			var p post
+			if err = rows.Scan(&p.id, &p.title, &p.detail); err != nil {
+				rows.Close()
+				return err
+			}
+
+			posts = append(posts, p)
+		}
+
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, p := range posts {
+			if d.IsSQLite() {
+				_, err = tx.Exec("insert into post_fts (docid, title, detail) values (?, ?, ?)",
+					p.id, tokenizer.IndexText(p.title), tokenizer.IndexText(p.detail))
+			} else {
+				_, err = tx.Exec(d.Rebind(`insert into "post_search" ("post_id", "body") values (?, ?)`),
+					p.id, tokenizer.Normalize(p.title+"\n"+p.detail))
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(posts) < reindexBatchSize {
+			return nil
+		}
+
+		lastId = posts[len(posts)-1].id
+	}
+}
@@ -0,0 +1,69 @@
+package migrations
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// UsersJsonFile は取得対象のユーザーを画面で管理する前に、batchが取得するユーザーを指定していたファイル
+// 設定ファイルのusersjson(util.Config.UsersJsonPath)を適用の前に設定する。空の場合はファイルを読まない
+var UsersJsonFile = ""
+
+// activateUsers はusers.jsonに指定されていたユーザーを取得対象(active)にする
+// 掲示板の取得で追加されたユーザーは、以前もusers.jsonにない限り個別には取得していなかった
+//
+// users.jsonが読めない場合、掲示板を取得したことがなければ全てのユーザーはusers.jsonから登録されたものなので全員を取得対象にする
+// 掲示板を取得したことがある場合は区別できないので、推測せずにエラーにする
+func activateUsers(tx *sql.Tx, d *Dialect) error {
+	var users int
+	err := tx.QueryRow(d.Rebind(`select count(*) from "user"`)).Scan(&users)
+	if err != nil || users == 0 {
+		return err
+	}
+
+	var data []byte
+	if UsersJsonFile != "" {
+		data, err = ioutil.ReadFile(UsersJsonFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if data == nil {
+		var boards int
+		err = tx.QueryRow(`select count(*) from board_watermark`).Scan(&boards)
+		if err != nil {
+			return err
+		}
+
+		if boards > 0 {
+			return fmt.Errorf("users.json is not found (usersjson : %q). set usersjson in config.json to the users.json of batch, "+
+				"or to a file containing [] and import users to crawl with batch -import", UsersJsonFile)
+		}
+
+		_, err = tx.Exec(d.Rebind(`update "user" set "active"=?`), true)
+
+		return err
+	}
+
+	var list []struct {
+		YahooId string `json:"YahooId"`
+	}
+
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("%s : %v", UsersJsonFile, err)
+	}
+
+	for _, u := range list {
+		_, err = tx.Exec(d.Rebind(`update "user" set "active"=? where "yahoo_id"=?`), true, u.YahooId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package migrations
+
+// All は全てのマイグレーション。Versionの昇順に並べ、適用済みのものは変更しないこと
+// 各文はDialectを値にしたtext/templateで、型などDBによって異なる部分は{{.Serial}}のように書く
+// sqlite3だけに対応していた頃の1〜5は、sqlite3で実行するSQLが変わらないようにテンプレートにしている
+var All = []Migration{
+	{
+		// CreateTablesIfNotExistsで作成していた頃のDBにも適用できるように、if not existsで作成する
+		Version: 1,
+		Name:    "create initial tables",
+		Up: []string{
+			`create table if not exists "user" ("id" {{.Serial}}, "yahoo_id" varchar(255) not null, "display_name" varchar(255), "url" varchar(255) not null){{.TableOptions}}`,
+			`create table if not exists "brand" ("id" {{.Serial}}, "brand_name" varchar(255) not null, "url" varchar(255) not null){{.TableOptions}}`,
+			`create table if not exists "post" ("id" {{.Serial}}, "user_id" integer not null, "brand_id" integer not null, "comment_no" varchar(255) not null, "title" varchar(255) not null, "url" varchar(255) not null, "ref_no" varchar(255), "ref_url" varchar(255), "detail" varchar(10000) not null, "post_time" {{.Datetime}}){{.TableOptions}}`,
+			`create table if not exists "brand_notification" ("brand_id" integer not null primary key, "post_time" {{.Datetime}}){{.TableOptions}}`,
+			`create table if not exists "post_notification" ("post_id" integer not null primary key){{.TableOptions}}`,
+		},
+		Down: []string{
+			`drop table "post_notification"`,
+			`drop table "brand_notification"`,
+			`drop table "post"`,
+			`drop table "brand"`,
+			`drop table "user"`,
+		},
+	},
+	{
+		// 一意制約がなかった頃に重複して保存された投稿は、最初のもの以外削除する
+		// (mysqlは削除するテーブルをサブクエリで直接参照できないので、導出テーブルにする)
+		Version: 2,
+		Name:    "add unique index on post url",
+		Up: []string{
+			`delete from post_notification where post_id not in ({{if .IsMySQL}}select id from (select min(id) as id from post group by url) T{{else}}select min(id) from post group by url{{end}})`,
+			`delete from post where id not in ({{if .IsMySQL}}select id from (select min(id) as id from post group by url) T{{else}}select min(id) from post group by url{{end}})`,
+			`create unique index {{if not .IsMySQL}}if not exists {{end}}post_url on post(url)`,
+		},
+		Down: []string{
+			`drop index post_url{{if .IsMySQL}} on post{{end}}`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "create crawl_watermark",
+		Up: []string{
+			`create table if not exists "crawl_watermark" ("user_id" integer not null primary key, "url" varchar(255) not null, "comment_no" varchar(255) not null, "post_time" {{.Datetime}}){{.TableOptions}}`,
+		},
+		Down: []string{
+			`drop table "crawl_watermark"`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create board_watermark",
+		Up: []string{
+			`create table if not exists "board_watermark" ("brand_id" integer not null primary key, "url" varchar(255) not null, "comment_no" varchar(255) not null, "post_time" {{.Datetime}}){{.TableOptions}}`,
+		},
+		Down: []string{
+			`drop table "board_watermark"`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create crawl_state",
+		Up: []string{
+			`create table if not exists "crawl_state" ("url" varchar(255) not null primary key, "next_url" varchar(255) not null, "posts" {{.Text}} not null, "updated_at" {{.Datetime}}){{.TableOptions}}`,
+		},
+		Down: []string{
+			`drop table "crawl_state"`,
+		},
+	}, {
+		// 全文検索はsqlite3のFTS4を使う。他のDBではpostをlikeで検索する
+		// 索引はPostRepo.Saveで投稿と同時に更新する
+		Version: 6,
+		Name:    "create post_fts",
+		Up: []string{
+			`{{if .IsSQLite}}create virtual table if not exists post_fts using fts4(title, detail, tokenize=unicode61){{end}}`,
+			`{{if .IsSQLite}}insert into post_fts (docid, title, detail) select id, title, detail from post{{end}}`,
+		},
+		Down: []string{
+			`{{if .IsSQLite}}drop table post_fts{{end}}`,
+		},
+	}, {
+		// 日本語を検索できるように、正規化した文字のn-gramで索引を作り直す(tokenizerパッケージ)
+		// sqlite3以外は正規化した本文をpost_searchに持ち、likeで検索する
+		Version: 7,
+		Name:    "rebuild search index with n-gram tokens",
+		Up: []string{
+			`{{if .IsSQLite}}drop table post_fts{{end}}`,
+			`{{if .IsSQLite}}create virtual table post_fts using fts4(title, detail, tokenize=simple){{end}}`,
+			`{{if not .IsSQLite}}create table "post_search" ("post_id" integer not null primary key, "body" {{.Text}} not null){{.TableOptions}}{{end}}`,
+		},
+		UpFunc: reindexPosts,
+		Down: []string{
+			`{{if .IsSQLite}}drop table post_fts{{end}}`,
+			`{{if .IsSQLite}}create virtual table post_fts using fts4(title, detail, tokenize=unicode61){{end}}`,
+			`{{if .IsSQLite}}insert into post_fts (docid, title, detail) select id, title, detail from post{{end}}`,
+			`{{if not .IsSQLite}}drop table "post_search"{{end}}`,
+		},
+	}, {
+		// 新規投稿の通知の送信結果。通知先と投稿ごとに記録する
+		Version: 8,
+		Name:    "create notification_delivery",
+		Up: []string{
+			`create table if not exists "notification_delivery" ("id" {{.Serial}}, "channel" varchar(255) not null, "post_id" integer not null, "status" varchar(255) not null, "attempts" integer not null, "error" {{.Text}}, "delivered_at" {{.Datetime}}){{.TableOptions}}`,
+			`create index {{if not .IsMySQL}}if not exists {{end}}notification_delivery_post_id on notification_delivery(post_id)`,
+		},
+		Down: []string{
+			`drop table "notification_delivery"`,
+		},
+	}, {
+		// 投稿の監視条件と、条件に該当した投稿のアラート。同じ条件で同じ投稿のアラートは1件のみ
+		Version: 9,
+		Name:    "create watch_rule and alert",
+		Up: []string{
+			`create table if not exists "watch_rule" ("id" {{.Serial}}, "name" varchar(255) not null, "pattern" varchar(1000) not null, "match_type" varchar(255) not null, "target" varchar(255) not null, "user_id" integer, "brand_id" integer, "enabled" boolean not null, "created_at" {{.Datetime}}, "updated_at" {{.Datetime}}){{.TableOptions}}`,
+			`create table if not exists "alert" ("id" {{.Serial}}, "watch_rule_id" integer not null, "post_id" integer not null, "seen" boolean not null, "created_at" {{.Datetime}}){{.TableOptions}}`,
+			`create unique index {{if not .IsMySQL}}if not exists {{end}}alert_watch_rule_id_post_id on alert(watch_rule_id, post_id)`,
+		},
+		Down: []string{
+			`drop table "alert"`,
+			`drop table "watch_rule"`,
+		},
+	}, {
+		// activeがtrueのユーザーをバッチで取得する。掲示板の取得で追加されたユーザーはfalse
+		// 以前users.jsonで指定して取得していたユーザーは取得対象にする(activateUsers)
+		Version: 10,
+		Name:    "add active to user",
+		Up: []string{
+			`alter table "user" add column "active" boolean not null default false`,
+		},
+		UpFunc: activateUsers,
+		Down: []string{
+			`alter table "user" drop column "active"`,
+		},
+	}, {
+		// 途中経過を開始URLではなく取得対象(ユーザーか銘柄)と取得方法ごとに保存する
+		// 作り直すので、中断していた取得は次回最初から取得し直す
+		Version: 11,
+		Name:    "key crawl_state by job",
+		Up: []string{
+			`drop table "crawl_state"`,
+			`create table "crawl_state" ("job_key" varchar(255) not null primary key, "url" varchar(255) not null, "next_url" varchar(255) not null, "posts" {{.Text}} not null, "updated_at" {{.Datetime}}){{.TableOptions}}`,
+		},
+		Down: []string{
+			`drop table "crawl_state"`,
+			`create table "crawl_state" ("url" varchar(255) not null primary key, "next_url" varchar(255) not null, "posts" {{.Text}} not null, "updated_at" {{.Datetime}}){{.TableOptions}}`,
+		},
+	},
+}
@@ -0,0 +1,153 @@
+// Package tokenizer は検索の索引と検索語に使う文字列の正規化とn-gramへの分割
+//
+// 日本語は単語の区切りがないので、文字のn-gramで索引を作る
+// 索引と検索語を同じ方法で正規化するので、全角と半角、ひらがなとカタカナ、大文字と小文字を区別しない
+package tokenizer
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// N はn-gramの文字数
+const N = 2
+
+// Span は正規化した1文字と、その元になった文字列でのバイト位置
+type Span struct {
+	Rune  rune
+	Start int
+	End   int
+}
+
+// Spans はsを正規化して1文字ずつ返す
+//
+// NFKCで全角英数を半角に、半角カナを全角にし(濁点も結合する)、
+// ひらがなをカタカナに、大文字を小文字にそろえる
+func Spans(s string) []Span {
+	spans := make([]Span, 0, len(s))
+
+	for start := 0; start < len(s); {
+		end := start + norm.NFKC.NextBoundaryInString(s[start:], true)
+		if end <= start {
+			end = len(s)
+		}
+
+		for _, r := range norm.NFKC.String(s[start:end]) {
+			spans = append(spans, Span{Rune: fold(r), Start: start, End: end})
+		}
+
+		start = end
+	}
+
+	return spans
+}
+
+// Normalize はsを正規化した文字列
+func Normalize(s string) string {
+	spans := Spans(s)
+
+	rs := make([]rune, len(spans))
+	for i, sp := range spans {
+		rs[i] = sp.Rune
+	}
+
+	return string(rs)
+}
+
+// Segments はsを正規化して、文字と数字が続く部分ごとに分ける
+// 空白や記号は区切りとして扱い、索引に含めない
+func Segments(s string) []string {
+	segs := make([]string, 0)
+	for _, seg := range segments(s) {
+		segs = append(segs, string(seg))
+	}
+
+	return segs
+}
+
+// Tokenize は索引に登録する語
+//
+// 各部分のn-gramに加えて末尾の1文字も登録し、
+// 1文字の検索語が前方一致でどの位置の文字にも一致するようにする
+func Tokenize(s string) []string {
+	tokens := make([]string, 0)
+	for _, seg := range segments(s) {
+		tokens = append(tokens, ngrams(seg)...)
+		tokens = append(tokens, string(seg[len(seg)-1:]))
+	}
+
+	return tokens
+}
+
+// QueryPhrases は検索語を部分ごとのn-gramの並びにする
+// 1文字の部分はその1文字だけになるので、前方一致で検索する
+func QueryPhrases(s string) [][]string {
+	phrases := make([][]string, 0)
+	for _, seg := range segments(s) {
+		if len(seg) < N {
+			phrases = append(phrases, []string{string(seg)})
+			continue
+		}
+
+		phrases = append(phrases, ngrams(seg))
+	}
+
+	return phrases
+}
+
+func segments(s string) [][]rune {
+	segs := make([][]rune, 0)
+
+	var seg []rune
+	for _, sp := range Spans(s) {
+		if isTokenRune(sp.Rune) {
+			seg = append(seg, sp.Rune)
+			continue
+		}
+
+		if len(seg) > 0 {
+			segs = append(segs, seg)
+			seg = nil
+		}
+	}
+
+	if len(seg) > 0 {
+		segs = append(segs, seg)
+	}
+
+	return segs
+}
+
+func ngrams(seg []rune) []string {
+	if len(seg) < N {
+		return nil
+	}
+
+	grams := make([]string, 0, len(seg)-N+1)
+	for i := 0; i+N <= len(seg); i++ {
+		grams = append(grams, string(seg[i:i+N]))
+	}
+
+	return grams
+}
+
+func isTokenRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r)
+}
+
+// ひらがなはカタカナに、大文字は小文字にする
+func fold(r rune) rune {
+	switch {
+	case 'ぁ' <= r && r <= 'ゖ', r == 'ゝ', r == 'ゞ':
+		return r + 'ァ' - 'ぁ'
+	}
+
+	return unicode.ToLower(r)
+}
+
+// IndexText はFTSの索引に登録する文字列。語を空白で区切る
+func IndexText(s string) string {
+	return strings.Join(Tokenize(s), " ")
+}
@@ -0,0 +1,79 @@
+package tokenizer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"ＡＢＣ１２３", "abc123"},
+		{"ｽﾄｯﾌﾟ高", "ストップ高"},
+		{"すとっぷ高", "ストップ高"},
+		{"ガギグ", "ガギグ"},
+		{"ｶﾞｷﾞｸﾞ", "ガギグ"},
+		{"Stop High", "stop high"},
+		{"決算　発表", "決算 発表"},
+		{"ゝゞ", "ヽヾ"},
+	}
+
+	for _, tt := range tests {
+		if got := Normalize(tt.in); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	// 半角の濁点は前の文字と合わせて1文字になり、元の位置は2文字分になる
+	s := "aｶﾞb"
+	want := []Span{
+		{'a', 0, 1},
+		{'ガ', 1, 7},
+		{'b', 7, 8},
+	}
+
+	if got := Spans(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("Spans(%q) = %v, want %v", s, got, want)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"決算", []string{"決算", "算"}},
+		{"明日は決算！", []string{"明日", "日ハ", "ハ決", "決算", "算"}},
+		{"S&P 500", []string{"s", "p", "50", "00", "0"}},
+	}
+
+	for _, tt := range tests {
+		if got := Tokenize(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQueryPhrases(t *testing.T) {
+	tests := []struct {
+		in   string
+		want [][]string
+	}{
+		{"", [][]string{}},
+		{"!!", [][]string{}},
+		{"株", [][]string{{"株"}}},
+		{"ｽﾄｯﾌﾟ高", [][]string{{"スト", "トッ", "ップ", "プ高"}}},
+		{"決算・発表", [][]string{{"決算"}, {"発表"}}},
+	}
+
+	for _, tt := range tests {
+		if got := QueryPhrases(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("QueryPhrases(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package util
+
+import (
+	"net/url"
+)
+
+// IsHttpUrl はsがホストを含むhttpかhttpsの絶対URLの場合trueを返す
+func IsHttpUrl(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
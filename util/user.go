@@ -0,0 +1,54 @@
+package util
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// USER_PAGE_URL はユーザーの投稿履歴のページ。userパラメータがYahoo ID
+const USER_PAGE_URL = "http://textream.yahoo.co.jp/personal/history/comment"
+
+// TextreamUserId はユーザーのページのURLのuserパラメータを返す。ユーザーのページでない場合は空文字列
+func TextreamUserId(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host != "textream.yahoo.co.jp" || u.Path != "/personal/history/comment" {
+		return ""
+	}
+
+	return u.Query().Get("user")
+}
+
+// ValidateUser は取得対象のユーザーの入力内容に誤りがある場合、そのメッセージを返す
+// 画面での登録とbatch -importで同じ条件にする
+func ValidateUser(yahooId string, displayName string, rawurl string) string {
+	if yahooId == "" {
+		return "Yahoo IDを入力してください。"
+	}
+
+	if strings.ContainsAny(yahooId, " \t\r\n/?#&") {
+		return "Yahoo IDに空白や記号(/?#&)は使えません。"
+	}
+
+	for _, s := range []string{yahooId, displayName, rawurl} {
+		if utf8.RuneCountInString(s) > 255 {
+			return "255文字以内で入力してください。"
+		}
+	}
+
+	if !IsHttpUrl(rawurl) {
+		return "URLはhttp://かhttps://で始まる形式で入力してください。"
+	}
+
+	id := TextreamUserId(rawurl)
+	if id == "" {
+		return "URLはTextreamのユーザーのページ(" + USER_PAGE_URL + "?user=...)を入力してください。"
+	}
+
+	if id != yahooId {
+		return fmt.Sprintf("URLのユーザー(%s)がYahoo IDと一致しません。", id)
+	}
+
+	return ""
+}
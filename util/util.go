@@ -2,23 +2,205 @@ package util
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 const CONFIG_FILE = "./config.json"
 
-var Cfg *Config
+// Cfg は設定ファイルを読み込むまではデフォルト値。mainの最初でLoadConfigを呼ぶこと
+var Cfg = defaultConfig()
+
+// SiteLocation はサイトに表示される日時のタイムゾーン
+var SiteLocation = loadLocation("Asia/Tokyo", time.FixedZone("JST", 9*60*60))
+
+// DisplayLocation は画面や出力に日時を表示する場合のタイムゾーン(設定ファイルのtimezone)
+var DisplayLocation = SiteLocation
 
 type Config struct {
-	DBFile string `json:"dbfile"`
+	DBFile   string `json:"dbfile"`
+	TimeZone string `json:"timezone"`
+	// 起動時に未適用のマイグレーションを適用する
+	AutoMigrate bool `json:"automigrate"`
+	// 取得対象のユーザーを画面で管理する前にbatchが読み込んでいたusers.json
+	// マイグレーション10でこのファイルのユーザーを取得対象にする
+	UsersJson string         `json:"usersjson"`
+	DB        DBConfig       `json:"db"`
+	Crawler   CrawlerConfig  `json:"crawler"`
+	Notifier  NotifierConfig `json:"notifier"`
+}
+
+type DBConfig struct {
+	// sqlite3(空の場合も)、postgres、mysql
+	Dialect string `json:"dialect"`
+	// sqlite3で空の場合はdbfileから作成する
+	DSN string `json:"dsn"`
+	// 0の場合は制限しない
+	MaxOpenConns int `json:"maxopenconns"`
+	MaxIdleConns int `json:"maxidleconns"`
+	// sqlite3の場合のみ
+	BusyTimeoutMsec int  `json:"busytimeoutmsec"`
+	WAL             bool `json:"wal"`
+}
+
+// DBPath はDBファイルのパス。相対パスの場合はGOPATHからのパスとみなす
+func (c *Config) DBPath() string {
+	if filepath.IsAbs(c.DBFile) {
+		return c.DBFile
+	}
+
+	return filepath.Join(os.Getenv("GOPATH"), c.DBFile)
+}
+
+// UsersJsonPath はusersjsonのパス。相対パスの場合はGOPATHからのパスとみなす。未設定の場合は空文字列
+func (c *Config) UsersJsonPath() string {
+	if c.UsersJson == "" || filepath.IsAbs(c.UsersJson) {
+		return c.UsersJson
+	}
+
+	return filepath.Join(os.Getenv("GOPATH"), c.UsersJson)
+}
+
+// DataSource はsql.Openに渡すドライバ名と接続文字列
+func (c *Config) DataSource() (string, string) {
+	if c.DB.Dialect != "" && c.DB.Dialect != "sqlite3" {
+		return c.DB.Dialect, c.DB.DSN
+	}
+
+	if c.DB.DSN != "" {
+		return "sqlite3", c.DB.DSN
+	}
+
+	// busy_timeoutとjournal_modeは接続ごとの設定なので、PRAGMAではなく接続文字列で指定する
+	// WALにすると書き込み中でも読み込みがブロックされない
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=%d", c.DBPath(), c.DB.BusyTimeoutMsec)
+	if c.DB.WAL {
+		dsn += "&_journal_mode=WAL"
+	}
+
+	return "sqlite3", dsn
+}
+
+type CrawlerConfig struct {
+	// 0の場合はGOMAXPROCSを変更しない
+	GoMaxProcs  int             `json:"gomaxprocs"`
+	Workers     int             `json:"workers"`
+	QueueSize   int             `json:"queuesize"`
+	TimeoutMsec int             `json:"timeoutmsec"`
+	Retry       RetryConfig     `json:"retry"`
+	RateLimit   RateLimitConfig `json:"ratelimit"`
+	Schedule    ScheduleConfig  `json:"schedule"`
+	// 掲示板も取得する銘柄のID
+	Boards []int `json:"boards"`
+	// 前回の取得位置がない場合に遡る日数。0の場合は全て取得する
+	LookbackDays int `json:"lookbackdays"`
+	// -backfillで取得する最大ページ数。0の場合は制限しない
+	BackfillMaxPages int `json:"backfillmaxpages"`
 }
 
-func init() {
-	LoadConfig()
+type RetryConfig struct {
+	MaxAttempts         int     `json:"maxattempts"`
+	InitialIntervalMsec int     `json:"initialintervalmsec"`
+	MaxIntervalMsec     int     `json:"maxintervalmsec"`
+	Multiplier          float64 `json:"multiplier"`
+	Jitter              float64 `json:"jitter"`
 }
 
+type RateLimitConfig struct {
+	RequestsPerSec float64 `json:"requestspersec"`
+	Burst          int     `json:"burst"`
+	PerHost        bool    `json:"perhost"`
+}
+
+// cronが指定された場合はintervalminより優先する
+type ScheduleConfig struct {
+	IntervalMin int    `json:"intervalmin"`
+	Cron        string `json:"cron"`
+}
+
+// NotifierConfig は新規投稿の通知先。channelsが空の場合は通知しない
+type NotifierConfig struct {
+	TimeoutMsec int         `json:"timeoutmsec"`
+	Retry       RetryConfig `json:"retry"`
+	// 送信待ちにできる通知の数。超えた分は通知せず、送信失敗として記録する
+	QueueSize int             `json:"queuesize"`
+	Channels  []ChannelConfig `json:"channels"`
+}
+
+// ChannelConfig のtypeはwebhook(JSON)、slack(Slack互換のIncoming Webhook)、smtp
+type ChannelConfig struct {
+	// 送信記録に使う名前。空の場合はtype
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// webhookとslackの送信先
+	Url string `json:"url"`
+	// 本文のtext/template。空の場合はtypeごとの既定の形式
+	Template string     `json:"template"`
+	Smtp     SmtpConfig `json:"smtp"`
+}
+
+type SmtpConfig struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// 空の場合は認証しない
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// 件名のtext/template。空の場合は既定の件名
+	Subject string `json:"subject"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		AutoMigrate: true,
+		DB: DBConfig{
+			MaxOpenConns:    4,
+			MaxIdleConns:    2,
+			BusyTimeoutMsec: 5000,
+			WAL:             true,
+		},
+		Crawler: CrawlerConfig{
+			Workers:          3,
+			QueueSize:        100,
+			TimeoutMsec:      30000,
+			LookbackDays:     365,
+			BackfillMaxPages: 100,
+			Retry: RetryConfig{
+				MaxAttempts:         4,
+				InitialIntervalMsec: 2000,
+				MaxIntervalMsec:     60000,
+				Multiplier:          2,
+				Jitter:              0.5,
+			},
+			RateLimit: RateLimitConfig{
+				RequestsPerSec: 0.9,
+				Burst:          1,
+				PerHost:        true,
+			},
+			Schedule: ScheduleConfig{
+				IntervalMin: 30,
+			},
+		},
+		Notifier: NotifierConfig{
+			TimeoutMsec: 10000,
+			QueueSize:   100,
+			Retry: RetryConfig{
+				MaxAttempts:         3,
+				InitialIntervalMsec: 1000,
+				MaxIntervalMsec:     30000,
+				Multiplier:          2,
+				Jitter:              0.5,
+			},
+		},
+	}
+}
+
+// LoadConfig はカレントディレクトリのconfig.jsonを読み込む
 func LoadConfig() {
 	f, err := os.Open(CONFIG_FILE)
 	if err != nil {
@@ -32,8 +214,26 @@ func LoadConfig() {
 		log.Fatalln(err)
 	}
 
-	err = json.Unmarshal(data, &Cfg)
+	// 設定ファイルにない項目はデフォルト値のまま
+	Cfg = defaultConfig()
+
+	err = json.Unmarshal(data, Cfg)
 	if err != nil {
 		log.Fatalln(err)
 	}
+
+	if Cfg.TimeZone != "" {
+		DisplayLocation = loadLocation(Cfg.TimeZone, SiteLocation)
+	}
+}
+
+// タイムゾーンのデータベースがない環境ではdefを返す
+func loadLocation(name string, def *time.Location) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("%s : %v", name, err)
+		return def
+	}
+
+	return loc
 }
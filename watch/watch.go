@@ -0,0 +1,106 @@
+// Package watch は監視条件(db.WatchRule)と投稿の照合
+//
+// キーワードは検索と同じくtokenizerで正規化して比較するので、
+// 全角と半角、ひらがなとカタカナ、大文字と小文字を区別しない
+package watch
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"../db"
+	"../tokenizer"
+)
+
+var ErrNoCondition = errors.New("キーワード、ユーザ、銘柄のいずれかを指定してください。")
+
+// Matcher は照合できるようにした監視条件
+type Matcher struct {
+	Rule     db.WatchRule
+	keywords []string
+	re       *regexp.Regexp
+}
+
+// Compile は監視条件の内容が不正な場合エラーを返す
+func Compile(rule db.WatchRule) (*Matcher, error) {
+	m := &Matcher{Rule: rule}
+
+	switch rule.Target {
+	case db.TargetAll, db.TargetTitle, db.TargetDetail:
+	default:
+		return nil, fmt.Errorf("unknown target : %s", rule.Target)
+	}
+
+	switch rule.MatchType {
+	case db.MatchKeyword:
+		m.keywords = strings.Fields(tokenizer.Normalize(rule.Pattern))
+	case db.MatchRegex:
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("正規表現が不正です。 : %v", err)
+			}
+
+			m.re = re
+		}
+	default:
+		return nil, fmt.Errorf("unknown match type : %s", rule.MatchType)
+	}
+
+	if len(m.keywords) == 0 && m.re == nil && !rule.UserId.Valid && !rule.BrandId.Valid {
+		return nil, ErrNoCondition
+	}
+
+	return m, nil
+}
+
+// Match は投稿が全ての条件を満たす場合trueを返す
+func (m *Matcher) Match(p *db.Post) bool {
+	if m.Rule.UserId.Valid && int64(p.UserId) != m.Rule.UserId.Int64 {
+		return false
+	}
+
+	if m.Rule.BrandId.Valid && int64(p.BrandId) != m.Rule.BrandId.Int64 {
+		return false
+	}
+
+	texts := m.texts(p)
+
+	if m.re != nil {
+		matched := false
+		for _, s := range texts {
+			if m.re.MatchString(s) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(m.keywords) > 0 {
+		s := tokenizer.Normalize(strings.Join(texts, "\n"))
+		for _, k := range m.keywords {
+			if !strings.Contains(s, k) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (m *Matcher) texts(p *db.Post) []string {
+	switch m.Rule.Target {
+	case db.TargetTitle:
+		return []string{p.Title}
+	case db.TargetDetail:
+		return []string{p.Detail}
+	default:
+		return []string{p.Title, p.Detail}
+	}
+}
@@ -0,0 +1,57 @@
+package watch
+
+import (
+	"database/sql"
+	"testing"
+
+	"../db"
+)
+
+func TestMatch(t *testing.T) {
+	post := &db.Post{UserId: 1, BrandId: 2, Title: "ＳＵＭＣＯ 決算", Detail: "明日はすとっぷ高\nPER 12.5倍"}
+
+	tests := []struct {
+		rule db.WatchRule
+		want bool
+	}{
+		{db.WatchRule{Pattern: "sumco", MatchType: db.MatchKeyword, Target: db.TargetAll}, true},
+		{db.WatchRule{Pattern: "ストップ 決算", MatchType: db.MatchKeyword, Target: db.TargetAll}, true},
+		{db.WatchRule{Pattern: "ストップ 決算", MatchType: db.MatchKeyword, Target: db.TargetDetail}, false},
+		{db.WatchRule{Pattern: "決算", MatchType: db.MatchKeyword, Target: db.TargetTitle}, true},
+		{db.WatchRule{Pattern: "増資", MatchType: db.MatchKeyword, Target: db.TargetAll}, false},
+		{db.WatchRule{Pattern: `PER \d+(\.\d+)?倍`, MatchType: db.MatchRegex, Target: db.TargetDetail}, true},
+		{db.WatchRule{Pattern: `^明日`, MatchType: db.MatchRegex, Target: db.TargetAll}, true},
+		{db.WatchRule{Pattern: `^明日`, MatchType: db.MatchRegex, Target: db.TargetTitle}, false},
+		{db.WatchRule{MatchType: db.MatchKeyword, Target: db.TargetAll, UserId: sql.NullInt64{Int64: 1, Valid: true}}, true},
+		{db.WatchRule{MatchType: db.MatchKeyword, Target: db.TargetAll, UserId: sql.NullInt64{Int64: 3, Valid: true}}, false},
+		{db.WatchRule{Pattern: "決算", MatchType: db.MatchKeyword, Target: db.TargetAll, BrandId: sql.NullInt64{Int64: 2, Valid: true}}, true},
+		{db.WatchRule{Pattern: "決算", MatchType: db.MatchKeyword, Target: db.TargetAll, BrandId: sql.NullInt64{Int64: 3, Valid: true}}, false},
+	}
+
+	for _, tt := range tests {
+		m, err := Compile(tt.rule)
+		if err != nil {
+			t.Errorf("Compile(%+v) : %v", tt.rule, err)
+			continue
+		}
+
+		if got := m.Match(post); got != tt.want {
+			t.Errorf("Match(%+v) = %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	tests := []db.WatchRule{
+		{Pattern: "(", MatchType: db.MatchRegex, Target: db.TargetAll},
+		{Pattern: "a", MatchType: "glob", Target: db.TargetAll},
+		{Pattern: "a", MatchType: db.MatchKeyword, Target: "body"},
+		{Pattern: " 　", MatchType: db.MatchKeyword, Target: db.TargetAll},
+	}
+
+	for _, rule := range tests {
+		if _, err := Compile(rule); err == nil {
+			t.Errorf("Compile(%+v) should fail", rule)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+
+	"../db"
+	"../watch"
+)
+
+func registerAlerts(r *mux.Router) {
+	r.HandleFunc("/alerts/", AlertsHandler)
+	r.HandleFunc("/alerts/page/{page:[0-9]+}/", AlertsHandler)
+	r.HandleFunc("/rules/", RulesHandler)
+	r.HandleFunc("/rules/new/", RuleEditHandler)
+	r.HandleFunc("/rules/{id:[0-9]+}/", RuleEditHandler)
+	r.HandleFunc("/rules/{id:[0-9]+}/enabled/", RuleEnabledHandler)
+}
+
+type IndexDto struct {
+	// 未読のアラートの件数
+	UnseenAlerts int
+}
+
+type AlertsDto struct {
+	// 0でない場合はこの監視条件のアラートのみ
+	WatchRuleId int
+	Alerts      []db.AlertView
+}
+
+// RuleDto は監視条件の編集画面の入力内容
+type RuleDto struct {
+	// 新規作成の場合は0
+	Id        int
+	Name      string
+	Pattern   string
+	MatchType string
+	Target    string
+	UserId    int
+	BrandId   int
+	Enabled   bool
+	Error     string
+	Users     []db.UserPostTimeView
+	Brands    []db.BrandPostTimeView
+}
+
+// 表示したアラートは既読にする
+func AlertsHandler(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	container := db.NewTxContainer()
+
+	s, ok := v["page"]
+	if !ok {
+		s = "1"
+	}
+
+	current, _ := strconv.Atoi(s)
+	if current < 1 {
+		log.Printf("invalid page number: %d", current)
+		current = 1
+	}
+	offset := (current - 1) * PER_PAGE
+
+	dto := &AlertsDto{}
+	dto.WatchRuleId, _ = strconv.Atoi(r.URL.Query().Get("rule"))
+
+	var total int
+	err := container.DoContext(r.Context(), writeTx, func(tc *db.TxContainer) error {
+		var err error
+
+		repo := db.NewAlertRepo(tc)
+
+		total, dto.Alerts, err = repo.List(db.AlertFilter{WatchRuleId: dto.WatchRuleId, Limit: PER_PAGE, Offset: offset})
+		if err != nil {
+			return err
+		}
+
+		ids := make([]int, 0, len(dto.Alerts))
+		for _, a := range dto.Alerts {
+			if !a.Seen {
+				ids = append(ids, a.Id)
+			}
+		}
+
+		return repo.MarkSeen(ids)
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	path := "/alerts/page/%d/"
+	if dto.WatchRuleId != 0 {
+		path += fmt.Sprintf("?rule=%d", dto.WatchRuleId)
+	}
+
+	err = writeOutput(w, "アラート一覧", "./template/alerts.tmpl",
+		&ViewPage{
+			Dto:        dto,
+			ReturnPath: "/",
+			Pagination: NewPagination(
+				total,
+				PER_PAGE,
+				DISPLAY_PAGES,
+				current,
+				path,
+			),
+		})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func RulesHandler(w http.ResponseWriter, r *http.Request) {
+	container := db.NewTxContainer()
+
+	var rules []db.WatchRuleView
+	err := container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
+		var err error
+		rules, err = db.NewWatchRuleRepo(tc).List()
+
+		return err
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = writeOutput(w, "監視条件一覧", "./template/rules.tmpl", &ViewPage{Dto: rules, ReturnPath: "/"})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+// RuleEditHandler はGETで編集画面を表示し、POSTで保存して一覧に戻る
+// 入力内容に誤りがある場合は、エラーと入力内容を編集画面に表示する
+func RuleEditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// /rules/new/の場合は新規作成
+	s, edit := mux.Vars(r)["id"]
+	id, _ := strconv.Atoi(s)
+	container := db.NewTxContainer()
+
+	dto := &RuleDto{MatchType: db.MatchKeyword, Target: db.TargetAll, Enabled: true}
+
+	found := true
+	saved := false
+	err := container.DoContext(r.Context(), writeTx, func(tc *db.TxContainer) error {
+		var err error
+
+		repo := db.NewWatchRuleRepo(tc)
+
+		rule := &db.WatchRule{}
+		if edit {
+			rule, err = repo.Get(id)
+			if err != nil {
+				return err
+			}
+
+			if rule == nil {
+				found = false
+				return nil
+			}
+
+			dto.setRule(rule)
+		}
+
+		if r.Method == "POST" {
+			if err = r.ParseForm(); err != nil {
+				dto.Error = "入力内容を読み込めませんでした。"
+			} else {
+				dto.parseForm(r.PostForm)
+				dto.Error, err = dto.validate(tc)
+				if err != nil {
+					return err
+				}
+			}
+
+			if dto.Error == "" {
+				now := time.Now()
+				dto.apply(rule)
+				rule.UpdatedAt = now
+
+				if edit {
+					err = repo.Update(rule)
+				} else {
+					rule.CreatedAt = now
+					err = repo.Add(rule)
+				}
+
+				saved = err == nil
+
+				return err
+			}
+		}
+
+		dto.Users, err = db.NewUserRepo(tc).List(db.UserFilter{})
+		if err != nil {
+			return err
+		}
+
+		dto.Brands, err = db.NewBrandRepo(tc).List(db.BrandFilter{})
+
+		return err
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	if saved {
+		http.Redirect(w, r, "/rules/", http.StatusSeeOther)
+		return
+	}
+
+	title := "監視条件の追加"
+	if edit {
+		title = "監視条件の編集"
+	}
+
+	err = writeOutput(w, title, "./template/rule.tmpl", &ViewPage{Dto: dto, ReturnPath: "/rules/"})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+// RuleEnabledHandler は監視条件の有効、無効をenabledの値(1か0)にして一覧に戻る
+func RuleEnabledHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	enabled := r.PostFormValue("enabled") == "1"
+	container := db.NewTxContainer()
+
+	found := true
+	err := container.DoContext(r.Context(), writeTx, func(tc *db.TxContainer) error {
+		repo := db.NewWatchRuleRepo(tc)
+
+		rule, err := repo.Get(id)
+		if err != nil {
+			return err
+		}
+
+		if rule == nil {
+			found = false
+			return nil
+		}
+
+		rule.Enabled = enabled
+		rule.UpdatedAt = time.Now()
+
+		return repo.Update(rule)
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/rules/", http.StatusSeeOther)
+}
+
+func (d *RuleDto) setRule(rule *db.WatchRule) {
+	d.Id = rule.Id
+	d.Name = rule.Name
+	d.Pattern = rule.Pattern
+	d.MatchType = rule.MatchType
+	d.Target = rule.Target
+	d.UserId = int(rule.UserId.Int64)
+	d.BrandId = int(rule.BrandId.Int64)
+	d.Enabled = rule.Enabled
+}
+
+func (d *RuleDto) parseForm(form url.Values) {
+	d.Name = strings.TrimSpace(form.Get("name"))
+	d.Pattern = strings.TrimSpace(form.Get("pattern"))
+	d.MatchType = form.Get("match_type")
+	d.Target = form.Get("target")
+	d.UserId, _ = strconv.Atoi(form.Get("user"))
+	d.BrandId, _ = strconv.Atoi(form.Get("brand"))
+	d.Enabled = form.Get("enabled") == "1"
+}
+
+// apply は入力内容をruleに設定する。IdとCreatedAt、UpdatedAtは変更しない
+func (d *RuleDto) apply(rule *db.WatchRule) {
+	rule.Name = d.Name
+	rule.Pattern = d.Pattern
+	rule.MatchType = d.MatchType
+	rule.Target = d.Target
+	rule.UserId.Int64, rule.UserId.Valid = int64(d.UserId), d.UserId != 0
+	rule.BrandId.Int64, rule.BrandId.Valid = int64(d.BrandId), d.BrandId != 0
+	rule.Enabled = d.Enabled
+}
+
+// validate は入力内容に誤りがある場合、画面に表示するメッセージを返す
+func (d *RuleDto) validate(tc *db.TxContainer) (string, error) {
+	if d.Name == "" {
+		return "名前を入力してください。", nil
+	}
+
+	if utf8.RuneCountInString(d.Name) > 255 {
+		return "名前は255文字以内で入力してください。", nil
+	}
+
+	if utf8.RuneCountInString(d.Pattern) > 1000 {
+		return "キーワードは1000文字以内で入力してください。", nil
+	}
+
+	if d.UserId != 0 {
+		u, err := db.NewUserRepo(tc).Get(d.UserId)
+		if err != nil {
+			return "", err
+		}
+
+		if u == nil {
+			return "指定したユーザは存在しません。", nil
+		}
+	}
+
+	if d.BrandId != 0 {
+		bs, err := db.NewBrandRepo(tc).GetByIds([]int{d.BrandId})
+		if err != nil {
+			return "", err
+		}
+
+		if len(bs) == 0 {
+			return "指定した銘柄は存在しません。", nil
+		}
+	}
+
+	rule := &db.WatchRule{}
+	d.apply(rule)
+
+	if _, err := watch.Compile(*rule); err != nil {
+		return err.Error(), nil
+	}
+
+	return "", nil
+}
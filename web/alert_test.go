@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"../db"
+)
+
+func serveAlerts(method string, path string, form url.Values) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/", IndexHandler)
+	registerAlerts(r)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestRuleEdit(t *testing.T) {
+	f := addPostsFixture(t, "rule_edit")
+
+	// 入力内容に誤りがある場合は保存せずに編集画面を表示する
+	w := serveAlerts("POST", "/rules/new/", url.Values{"name": {"invalid"}, "pattern": {"("}, "match_type": {"regex"}, "target": {"all"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "正規表現が不正です。") {
+		t.Errorf("POST /rules/new/ = %d\n%s", w.Code, w.Body.String())
+	}
+
+	w = serveAlerts("POST", "/rules/new/", url.Values{"name": {"no condition"}, "match_type": {"keyword"}, "target": {"all"}})
+	if !strings.Contains(w.Body.String(), "キーワード、ユーザ、銘柄のいずれかを指定してください。") {
+		t.Errorf("POST /rules/new/ = %d\n%s", w.Code, w.Body.String())
+	}
+
+	form := url.Values{
+		"name":       {"rule_edit"},
+		"pattern":    {"TITLE"},
+		"match_type": {"keyword"},
+		"target":     {"title"},
+		"brand":      {fmt.Sprint(f.brand.Id)},
+		"enabled":    {"1"},
+	}
+
+	w = serveAlerts("POST", "/rules/new/", form)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/rules/" {
+		t.Fatalf("POST /rules/new/ = %d\n%s", w.Code, w.Body.String())
+	}
+
+	rule := findRule(t, "rule_edit")
+	if rule.Pattern != "TITLE" || rule.Target != db.TargetTitle || rule.BrandId.Int64 != int64(f.brand.Id) || rule.UserId.Valid || !rule.Enabled {
+		t.Errorf("rule = %+v", rule)
+	}
+
+	path := fmt.Sprintf("/rules/%d/", rule.Id)
+	w = serveAlerts("GET", path, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `value="TITLE"`) {
+		t.Errorf("GET %s = %d\n%s", path, w.Code, w.Body.String())
+	}
+
+	// チェックボックスを外すと無効になる
+	form.Del("enabled")
+	form.Set("user", fmt.Sprint(f.user.Id))
+	if w = serveAlerts("POST", path, form); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST %s = %d\n%s", path, w.Code, w.Body.String())
+	}
+
+	rule = findRule(t, "rule_edit")
+	if rule.Enabled || rule.UserId.Int64 != int64(f.user.Id) {
+		t.Errorf("rule = %+v", rule)
+	}
+
+	if w = serveAlerts("POST", path+"enabled/", url.Values{"enabled": {"1"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST %senabled/ = %d", path, w.Code)
+	}
+
+	if rule = findRule(t, "rule_edit"); !rule.Enabled {
+		t.Errorf("rule = %+v", rule)
+	}
+
+	w = serveAlerts("GET", "/rules/", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "rule_edit") {
+		t.Errorf("GET /rules/ = %d\n%s", w.Code, w.Body.String())
+	}
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{"GET", "/rules/0/", http.StatusNotFound},
+		{"POST", "/rules/0/enabled/", http.StatusNotFound},
+		{"GET", path + "enabled/", http.StatusMethodNotAllowed},
+		{"DELETE", path, http.StatusMethodNotAllowed},
+	} {
+		if w = serveAlerts(tt.method, tt.path, nil); w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	f := addPostsFixture(t, "alerts")
+
+	rule := db.WatchRule{Name: "alerts_rule", Pattern: "detail", MatchType: db.MatchKeyword, Target: db.TargetAll, Enabled: true}
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		if err := db.NewWatchRuleRepo(tc).Add(&rule); err != nil {
+			return err
+		}
+
+		return db.NewAlertRepo(tc).Add(&db.Alert{WatchRuleId: rule.Id, PostId: f.posts[1].Id, CreatedAt: time.Now()})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveAlerts("GET", "/", nil)
+	if !strings.Contains(w.Body.String(), `<span class="badge">1</span>`) {
+		t.Errorf("GET / = %d\n%s", w.Code, w.Body.String())
+	}
+
+	path := fmt.Sprintf("/alerts/?rule=%d", rule.Id)
+	w = serveAlerts("GET", path, nil)
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "alerts_rule") || !strings.Contains(body, f.posts[1].Url) || !strings.Contains(body, "New") {
+		t.Errorf("GET %s = %d\n%s", path, w.Code, body)
+	}
+
+	// 表示したアラートは既読になる
+	w = serveAlerts("GET", "/", nil)
+	if strings.Contains(w.Body.String(), `class="badge"`) {
+		t.Errorf("GET / = %d\n%s", w.Code, w.Body.String())
+	}
+}
+
+func findRule(t *testing.T, name string) *db.WatchRule {
+	var rule *db.WatchRule
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		rules, err := db.NewWatchRuleRepo(tc).List()
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rules {
+			if r.Name == name {
+				rule, err = db.NewWatchRuleRepo(tc).Get(r.Id)
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule == nil {
+		t.Fatalf("rule %s not found", name)
+	}
+
+	return rule
+}
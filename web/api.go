@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"../db"
+	"../util"
+)
+
+// ApiUser などは/api/v1/で返すJSON。画面と同じデータを返す
+// スクリプトから利用されるので、フィールド名は変更しないこと
+type ApiUser struct {
+	Id           int        `json:"id"`
+	YahooId      string     `json:"yahoo_id"`
+	DisplayName  *string    `json:"display_name"`
+	Url          string     `json:"url"`
+	LastPostTime *time.Time `json:"last_post_time"`
+	NewPostCount int        `json:"new_post_count"`
+}
+
+type ApiBrand struct {
+	Id           int        `json:"id"`
+	Name         string     `json:"name"`
+	Url          string     `json:"url"`
+	LastPostTime *time.Time `json:"last_post_time"`
+	NewPostCount int        `json:"new_post_count"`
+	IsNew        bool       `json:"is_new"`
+}
+
+type ApiPost struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	BrandId   int       `json:"brand_id"`
+	BrandName string    `json:"brand_name"`
+	BrandUrl  string    `json:"brand_url"`
+	CommentNo string    `json:"comment_no"`
+	Title     string    `json:"title"`
+	Url       string    `json:"url"`
+	RefNo     *string   `json:"ref_no"`
+	RefUrl    *string   `json:"ref_url"`
+	Detail    string    `json:"detail"`
+	PostTime  time.Time `json:"post_time"`
+	IsNew     bool      `json:"is_new"`
+}
+
+// ApiPagination はPaginationと同じ内容
+type ApiPagination struct {
+	Total        int   `json:"total"`
+	PerPage      int   `json:"per_page"`
+	DisplayPages int   `json:"display_pages"`
+	Current      int   `json:"current"`
+	Pages        []int `json:"pages"`
+	PrevEnabled  bool  `json:"prev_enabled"`
+	PrevPage     int   `json:"prev_page"`
+	NextEnabled  bool  `json:"next_enabled"`
+	NextPage     int   `json:"next_page"`
+}
+
+type ApiPostList struct {
+	Posts      []ApiPost     `json:"posts"`
+	Pagination ApiPagination `json:"pagination"`
+}
+
+type ApiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func registerApi(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/users/", apiGet(ApiUsersHandler))
+	api.HandleFunc("/users/{id:[0-9]+}/posts/", apiGet(ApiPostsByUserHandler))
+	api.HandleFunc("/brands/", apiGet(ApiBrandsHandler))
+	api.HandleFunc("/brands/{id:[0-9]+}/posts/", apiGet(ApiPostsByBrandHandler))
+	api.HandleFunc("/posts/", apiGet(ApiPostsHandler))
+	api.HandleFunc("/posts/{id:[0-9]+}/", apiGet(ApiPostHandler))
+	api.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeApiError(w, http.StatusNotFound, "not found")
+	})
+}
+
+// APIは参照のみなのでGETとHEAD以外は受け付けない
+func apiGet(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeApiError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func ApiUsersHandler(w http.ResponseWriter, r *http.Request) {
+	container := db.NewTxContainer()
+
+	var users []db.UserPostTimeView
+	err := container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
+		var err error
+		users, err = db.NewUserRepo(tc).List(db.UserFilter{Order: db.UserOrderByLastPost})
+
+		return err
+	})
+
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	list := make([]ApiUser, len(users))
+	for i, u := range users {
+		list[i] = ApiUser{
+			Id:           u.Id,
+			YahooId:      u.YahooId,
+			DisplayName:  nullString(u.DisplayName.String, u.DisplayName.Valid),
+			Url:          u.Url,
+			LastPostTime: nullTime(u.PostTime),
+			NewPostCount: u.NewPostCount,
+		}
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{"users": list})
+}
+
+func ApiBrandsHandler(w http.ResponseWriter, r *http.Request) {
+	container := db.NewTxContainer()
+
+	var brands []db.BrandPostTimeView
+	err := container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
+		var err error
+		brands, err = db.NewBrandRepo(tc).List(db.BrandFilter{HasPosts: true})
+
+		return err
+	})
+
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	list := make([]ApiBrand, len(brands))
+	for i, b := range brands {
+		list[i] = ApiBrand{
+			Id:           b.Id,
+			Name:         b.BrandName,
+			Url:          b.Url,
+			LastPostTime: nullTime(b.PostTime),
+			NewPostCount: b.NewPostCount,
+			IsNew:        b.BrandNotificationBrandId.Valid,
+		}
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{"brands": list})
+}
+
+func ApiPostsHandler(w http.ResponseWriter, r *http.Request) {
+	writeApiPosts(w, r, db.PostFilter{})
+}
+
+func ApiPostsByUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	writeApiPosts(w, r, db.PostFilter{UserId: id})
+}
+
+func ApiPostsByBrandHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	writeApiPosts(w, r, db.PostFilter{BrandId: id})
+}
+
+// ?page=nのページの投稿を返す。ユーザーや銘柄が存在しない場合は404
+// 画面と違って、参照しても新着の印は消さない
+func writeApiPosts(w http.ResponseWriter, r *http.Request, f db.PostFilter) {
+	container := db.NewTxContainer()
+
+	current := 1
+	if s := r.URL.Query().Get("page"); s != "" {
+		var err error
+		current, err = strconv.Atoi(s)
+		if err != nil || current < 1 {
+			writeApiError(w, http.StatusBadRequest, "invalid page number: "+s)
+			return
+		}
+	}
+
+	f.Limit = PER_PAGE
+	f.Offset = (current - 1) * PER_PAGE
+
+	found := true
+	var total int
+	var ps []db.PostView
+	err := container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
+		if f.UserId != 0 {
+			u, err := db.NewUserRepo(tc).Get(f.UserId)
+			if err != nil {
+				return err
+			}
+
+			found = u != nil
+		}
+
+		if f.BrandId != 0 {
+			bs, err := db.NewBrandRepo(tc).GetByIds([]int{f.BrandId})
+			if err != nil {
+				return err
+			}
+
+			found = len(bs) > 0
+		}
+
+		if !found {
+			return nil
+		}
+
+		var err error
+		total, ps, err = db.NewPostRepo(tc).List(f)
+
+		return err
+	})
+
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !found {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	p := NewPagination(total, PER_PAGE, DISPLAY_PAGES, current, "")
+
+	list := ApiPostList{
+		Posts: make([]ApiPost, len(ps)),
+		Pagination: ApiPagination{
+			Total:        p.Total,
+			PerPage:      p.PerPage,
+			DisplayPages: p.DisplayPages,
+			Current:      p.Current,
+			Pages:        p.Pages,
+			PrevEnabled:  p.PrevEnabled,
+			PrevPage:     p.PrevPage,
+			NextEnabled:  p.NextEnabled,
+			NextPage:     p.NextPage,
+		},
+	}
+
+	if list.Pagination.Pages == nil {
+		list.Pagination.Pages = []int{}
+	}
+
+	for i, p := range ps {
+		list.Posts[i] = convertPostViewToApiPost(p)
+	}
+
+	writeJson(w, http.StatusOK, list)
+}
+
+func ApiPostHandler(w http.ResponseWriter, r *http.Request) {
+	container := db.NewTxContainer()
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var p *db.PostView
+	err := container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
+		var err error
+		p, err = db.NewPostRepo(tc).GetView(id)
+
+		return err
+	})
+
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if p == nil {
+		writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{"post": convertPostViewToApiPost(*p)})
+}
+
+func convertPostViewToApiPost(p db.PostView) ApiPost {
+	return ApiPost{
+		Id:        p.Id,
+		UserId:    p.UserId,
+		BrandId:   p.BrandId,
+		BrandName: p.BrandName,
+		BrandUrl:  p.BrandUrl,
+		CommentNo: p.CommentNo,
+		Title:     p.Title,
+		Url:       p.Url,
+		RefNo:     nullString(p.RefNo.String, p.RefNo.Valid),
+		RefUrl:    nullString(p.RefUrl.String, p.RefUrl.Valid),
+		Detail:    p.Detail,
+		PostTime:  p.PostTime.In(util.DisplayLocation),
+		IsNew:     p.PostNotificationPostId.Valid,
+	}
+}
+
+// 値がない場合はnullにする
+func nullString(s string, valid bool) *string {
+	if !valid {
+		return nil
+	}
+
+	return &s
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	t = t.In(util.DisplayLocation)
+
+	return &t
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// 500の場合は詳細をログにのみ出力する
+func writeApiError(w http.ResponseWriter, status int, message string) {
+	if status == http.StatusInternalServerError {
+		log.Println(message)
+		message = http.StatusText(status)
+	}
+
+	writeJson(w, status, map[string]interface{}{"error": ApiError{Status: status, Message: message}})
+}
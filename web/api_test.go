@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"../db"
+	"../util"
+)
+
+// ハンドラのテストは一時ディレクトリのsqlite3のDBで行う
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "yahoo_textream")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	util.Cfg.DBFile = filepath.Join(dir, "data.db")
+	util.Cfg.AutoMigrate = true
+
+	if err = db.Open(); err != nil {
+		log.Fatalln(err)
+	}
+
+	code := m.Run()
+
+	db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type apiFixture struct {
+	user  db.User
+	brand db.Brand
+	posts []db.Post
+}
+
+// userがbrandに2件投稿し、1件目が未読
+func addApiFixture(t *testing.T) *apiFixture {
+	f := &apiFixture{
+		user:  db.User{YahooId: "api_user", Url: "http://example.com/api_user"},
+		brand: db.Brand{BrandName: "api_brand", Url: "http://example.com/api_brand"},
+	}
+
+	base := time.Date(2014, 6, 1, 9, 0, 0, 0, time.UTC)
+
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		if _, err := db.NewUserRepo(tc).AddIfNotExist(&f.user); err != nil {
+			return err
+		}
+
+		if err := db.NewBrandRepo(tc).Add(&f.brand); err != nil {
+			return err
+		}
+
+		for i := 0; i < 2; i++ {
+			p := db.Post{
+				UserId:    f.user.Id,
+				BrandId:   f.brand.Id,
+				CommentNo: fmt.Sprint(i + 1),
+				Title:     "title",
+				Url:       fmt.Sprintf("http://example.com/api/%d", i+1),
+				Detail:    "detail",
+				PostTime:  base.Add(time.Duration(i) * time.Hour),
+			}
+
+			if _, err := db.NewPostRepo(tc).Save(&p); err != nil {
+				return err
+			}
+
+			f.posts = append(f.posts, p)
+		}
+
+		return db.NewNotificationRepo(tc).AddPost(&db.PostNotification{PostId: f.posts[0].Id})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func serveApi(t *testing.T, method string, path string, v interface{}) int {
+	r := mux.NewRouter()
+	registerApi(r)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("%s %s Content-Type = %q", method, path, ct)
+	}
+
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s : %v\n%s", method, path, err, w.Body.String())
+		}
+	}
+
+	return w.Code
+}
+
+func TestApi(t *testing.T) {
+	f := addApiFixture(t)
+
+	var users struct {
+		Users []ApiUser `json:"users"`
+	}
+	if code := serveApi(t, "GET", "/api/v1/users/", &users); code != http.StatusOK || len(users.Users) != 1 {
+		t.Fatalf("users = %d, %+v", code, users)
+	}
+
+	u := users.Users[0]
+	if u.YahooId != "api_user" || u.DisplayName != nil || u.NewPostCount != 1 || u.LastPostTime == nil || !u.LastPostTime.Equal(f.posts[1].PostTime) {
+		t.Errorf("user = %+v", u)
+	}
+
+	var posts ApiPostList
+	path := fmt.Sprintf("/api/v1/users/%d/posts/", f.user.Id)
+	if code := serveApi(t, "GET", path, &posts); code != http.StatusOK {
+		t.Fatalf("%s = %d", path, code)
+	}
+
+	if len(posts.Posts) != 2 || posts.Posts[0].Id != f.posts[1].Id || posts.Posts[1].IsNew != true || posts.Posts[0].RefNo != nil {
+		t.Errorf("%s posts = %+v", path, posts.Posts)
+	}
+
+	if p := posts.Pagination; p.Total != 2 || p.Current != 1 || p.PerPage != PER_PAGE || len(p.Pages) != 1 || p.NextEnabled {
+		t.Errorf("%s pagination = %+v", path, p)
+	}
+
+	// ページの範囲外は空の一覧
+	path = fmt.Sprintf("/api/v1/brands/%d/posts/?page=2", f.brand.Id)
+	if code := serveApi(t, "GET", path, &posts); code != http.StatusOK || len(posts.Posts) != 0 || posts.Pagination.Pages == nil {
+		t.Errorf("%s = %d, %+v", path, code, posts)
+	}
+
+	var post struct {
+		Post ApiPost `json:"post"`
+	}
+	path = fmt.Sprintf("/api/v1/posts/%d/", f.posts[0].Id)
+	if code := serveApi(t, "GET", path, &post); code != http.StatusOK || post.Post.Url != f.posts[0].Url || post.Post.BrandName != "api_brand" {
+		t.Errorf("%s = %d, %+v", path, code, post)
+	}
+
+	// 参照しても新着の印は消えない
+	serveApi(t, "GET", "/api/v1/users/", &users)
+	if users.Users[0].NewPostCount != 1 {
+		t.Errorf("new_post_count = %d, want 1", users.Users[0].NewPostCount)
+	}
+}
+
+func TestApiError(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/api/v1/posts/?page=0", http.StatusBadRequest},
+		{"GET", "/api/v1/posts/?page=x", http.StatusBadRequest},
+		{"GET", "/api/v1/posts/999999/", http.StatusNotFound},
+		{"GET", "/api/v1/users/999999/posts/", http.StatusNotFound},
+		{"GET", "/api/v1/brands/999999/posts/", http.StatusNotFound},
+		{"GET", "/api/v1/unknown/", http.StatusNotFound},
+		{"POST", "/api/v1/posts/", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		var res struct {
+			Error ApiError `json:"error"`
+		}
+
+		if code := serveApi(t, tt.method, tt.path, &res); code != tt.status || res.Error.Status != tt.status {
+			t.Errorf("%s %s = %d, %+v, want %d", tt.method, tt.path, code, res, tt.status)
+		}
+	}
+}
+
+// 投稿がまだないユーザーも画面と同じく最後に返す
+func TestApiUsersWithoutPosts(t *testing.T) {
+	addPostsFixture(t, "api_noposts")
+
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		return db.NewUserRepo(tc).Add(&db.User{YahooId: "api_new_user", Url: "http://example.com/api_new_user", Active: true})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var users struct {
+		Users []ApiUser `json:"users"`
+	}
+	if code := serveApi(t, "GET", "/api/v1/users/", &users); code != http.StatusOK || len(users.Users) < 2 {
+		t.Fatalf("users = %d, %+v", code, users)
+	}
+
+	if u := users.Users[len(users.Users)-1]; u.YahooId != "api_new_user" || u.LastPostTime != nil || u.NewPostCount != 0 {
+		t.Errorf("user = %+v", u)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"../db"
+	"../util"
+)
+
+// FEED_SIZE はフィードに含める新しい投稿の数
+const FEED_SIZE = 30
+
+// FEED_ID_PREFIX はAtomのフィードのidの接頭辞(tag URI)
+// アクセスしたホスト名によってidが変わるとリーダーで重複するので、URLは使わない
+const FEED_ID_PREFIX = "tag:github.com,2014:taknb2nch/go-yahoo_textream"
+
+func registerFeeds(r *mux.Router) {
+	r.HandleFunc("/posts/feed.{format:atom|rss}", PostsFeedHandler)
+	r.HandleFunc("/posts/user/{id:[0-9]+}/feed.{format:atom|rss}", PostsByUserFeedHandler)
+	r.HandleFunc("/posts/brand/{id:[0-9]+}/feed.{format:atom|rss}", PostsByBrandFeedHandler)
+}
+
+// Feed はAtomとRSSに共通のフィードの内容
+type Feed struct {
+	// 画面のパスから作るので、ホスト名や形式(Atom、RSS)によって変わらない
+	Id    string
+	Title string
+	// フィードに対応する画面とフィード自身の絶対URL
+	Link string
+	Self string
+	// 最も新しい投稿の日時。投稿がない場合はゼロ値
+	Updated time.Time
+	Posts   []db.PostView
+}
+
+func PostsFeedHandler(w http.ResponseWriter, r *http.Request) {
+	writeFeed(w, r, db.PostFilter{}, "/posts/")
+}
+
+func PostsByUserFeedHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	writeFeed(w, r, db.PostFilter{UserId: id}, fmt.Sprintf("/posts/user/%d/", id))
+}
+
+func PostsByBrandFeedHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	writeFeed(w, r, db.PostFilter{BrandId: id}, fmt.Sprintf("/posts/brand/%d/", id))
+}
+
+// 画面と違って、フィードを取得しても新着の印は消さない
+// 内容のハッシュをETagにして条件付きGETに応答する
+// 投稿は同じ投稿日時のまま内容が更新されることがあるので、Last-Modifiedは返さない
+func writeFeed(w http.ResponseWriter, r *http.Request, f db.PostFilter, path string) {
+	container := db.NewTxContainer()
+
+	base := baseUrl(r)
+	feed := &Feed{
+		Id:    FEED_ID_PREFIX + path,
+		Title: "投稿一覧",
+		Link:  base + path,
+		Self:  base + r.URL.Path,
+	}
+
+	f.Limit = FEED_SIZE
+
+	found := true
+	err := container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
+		if f.UserId != 0 {
+			u, err := db.NewUserRepo(tc).Get(f.UserId)
+			if err != nil {
+				return err
+			}
+
+			if u == nil {
+				found = false
+				return nil
+			}
+
+			feed.Title += " - " + userName(u.YahooId, u.DisplayName.String, u.DisplayName.Valid)
+		}
+
+		if f.BrandId != 0 {
+			bs, err := db.NewBrandRepo(tc).GetByIds([]int{f.BrandId})
+			if err != nil {
+				return err
+			}
+
+			if len(bs) == 0 {
+				found = false
+				return nil
+			}
+
+			feed.Title += " - " + bs[0].BrandName
+		}
+
+		var err error
+		_, feed.Posts, err = db.NewPostRepo(tc).List(f)
+
+		return err
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(feed.Posts) > 0 {
+		feed.Updated = feed.Posts[0].PostTime
+	}
+
+	var v interface{}
+	var contentType string
+	if mux.Vars(r)["format"] == "rss" {
+		v, contentType = newRss(feed), "application/rss+xml; charset=utf-8"
+	} else {
+		v, contentType = newAtomFeed(feed), "application/atom+xml; charset=utf-8"
+	}
+
+	body, err := xml.Marshal(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	body = append([]byte(xml.Header), body...)
+
+	sum := sha1.Sum(body)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// リバースプロキシの後ろではX-Forwarded-Protoのスキームを使う
+func baseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host
+}
+
+func userName(yahooId string, displayName string, valid bool) string {
+	if valid && displayName != "" {
+		return displayName
+	}
+
+	return yahooId
+}
+
+func feedEntryTitle(p db.PostView) string {
+	return fmt.Sprintf("[%s] %s", p.BrandName, p.Title)
+}
+
+// Atom (RFC 4287)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Id        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Links     []atomLink   `xml:"link"`
+	Published string       `xml:"published"`
+	Updated   string       `xml:"updated"`
+	Author    atomPerson   `xml:"author"`
+	Category  atomCategory `xml:"category"`
+	Content   atomText     `xml:"content"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	Uri  string `xml:"uri,omitempty"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// エントリのidは投稿のURL(投稿ごとに一意で変わらない)
+func newAtomFeed(feed *Feed) *atomFeed {
+	a := &atomFeed{
+		Id:      feed.Id,
+		Title:   feed.Title,
+		Updated: formatAtomTime(feed.Updated),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: feed.Self},
+			{Rel: "alternate", Type: "text/html", Href: feed.Link},
+		},
+		Entries: make([]atomEntry, len(feed.Posts)),
+	}
+
+	for i, p := range feed.Posts {
+		a.Entries[i] = atomEntry{
+			Id:        p.Url,
+			Title:     feedEntryTitle(p),
+			Links:     []atomLink{{Rel: "alternate", Type: "text/html", Href: p.Url}},
+			Published: formatAtomTime(p.PostTime),
+			Updated:   formatAtomTime(p.PostTime),
+			Author:    atomPerson{Name: userName(p.UserYahooId, p.UserDisplayName.String, p.UserDisplayName.Valid)},
+			Category:  atomCategory{Term: p.BrandName},
+			Content:   atomText{Type: "text", Body: p.Detail},
+		}
+	}
+
+	return a
+}
+
+// updatedは必須なので、投稿がない場合は1970-01-01にする
+func formatAtomTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Unix(0, 0)
+	}
+
+	return t.In(util.DisplayLocation).Format(time.RFC3339)
+}
+
+// RSS 2.0
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Guid        rssGuid `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Category    string  `xml:"category"`
+	Description string  `xml:"description"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func newRss(feed *Feed) *rss {
+	ch := rssChannel{
+		Title:       feed.Title,
+		Link:        feed.Link,
+		Description: feed.Title,
+		Items:       make([]rssItem, len(feed.Posts)),
+	}
+
+	if !feed.Updated.IsZero() {
+		ch.LastBuildDate = formatRssTime(feed.Updated)
+	}
+
+	for i, p := range feed.Posts {
+		ch.Items[i] = rssItem{
+			Title:       feedEntryTitle(p),
+			Link:        p.Url,
+			Guid:        rssGuid{IsPermaLink: true, Value: p.Url},
+			PubDate:     formatRssTime(p.PostTime),
+			Category:    p.BrandName,
+			Description: p.Detail,
+		}
+	}
+
+	return &rss{Version: "2.0", Channel: ch}
+}
+
+func formatRssTime(t time.Time) string {
+	return t.In(util.DisplayLocation).Format(time.RFC1123Z)
+}
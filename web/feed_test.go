@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"../db"
+)
+
+func serveFeed(method string, path string, header http.Header) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	registerFeeds(r)
+
+	req := httptest.NewRequest(method, "http://example.org"+path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestAtomFeed(t *testing.T) {
+	f := addPostsFixture(t, "atom")
+
+	path := fmt.Sprintf("/posts/user/%d/feed.atom", f.user.Id)
+	w := serveFeed("GET", path, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s = %d", path, w.Code)
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/atom+xml; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var feed atomFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+
+	wantId := fmt.Sprintf("%s/posts/user/%d/", FEED_ID_PREFIX, f.user.Id)
+	if feed.Id != wantId || feed.Title != "投稿一覧 - atom_user" {
+		t.Errorf("feed = %s, %s", feed.Id, feed.Title)
+	}
+
+	if want := formatAtomTime(f.posts[1].PostTime); feed.Updated != want {
+		t.Errorf("updated = %s, want %s", feed.Updated, want)
+	}
+
+	if len(feed.Entries) != 2 {
+		t.Fatalf("entries = %d, want 2", len(feed.Entries))
+	}
+
+	e := feed.Entries[0]
+	if e.Id != f.posts[1].Url || e.Title != "[atom_brand] title" || e.Author.Name != "atom_user" || e.Content.Body != "detail" {
+		t.Errorf("entry = %+v", e)
+	}
+
+	// 別のホスト名でアクセスしてもidは変わらない
+	r := mux.NewRouter()
+	registerFeeds(r)
+
+	other := httptest.NewRecorder()
+	r.ServeHTTP(other, httptest.NewRequest("GET", "https://feeds.example.com"+path, nil))
+
+	var otherFeed atomFeed
+	if err := xml.Unmarshal(other.Body.Bytes(), &otherFeed); err != nil {
+		t.Fatal(err)
+	}
+
+	if otherFeed.Id != feed.Id || len(otherFeed.Entries) != 2 || otherFeed.Entries[0].Id != e.Id {
+		t.Errorf("feed from another host = %s, %+v", otherFeed.Id, otherFeed.Entries)
+	}
+
+	// 内容が変わっていなければ304を返す
+	etag := w.Header().Get("ETag")
+	if w := serveFeed("GET", path, http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match = %d, want 304", w.Code)
+	}
+
+	if w := serveFeed("GET", path, http.Header{"If-None-Match": {`"other"`}}); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match other = %d, want 200", w.Code)
+	}
+
+	// 投稿日時が同じでも内容が更新されていれば200を返す
+	if lm := w.Header().Get("Last-Modified"); lm != "" {
+		t.Errorf("Last-Modified = %s, want none", lm)
+	}
+
+	p := f.posts[1]
+	p.Title = "updated"
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		_, err := db.NewPostRepo(tc).Save(&p)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serveFeed("GET", path, http.Header{"If-None-Match": {etag}}); w.Code != http.StatusOK {
+		t.Errorf("If-None-Match after update = %d, want 200", w.Code)
+	}
+
+	since := p.PostTime.Add(time.Minute).UTC().Format(http.TimeFormat)
+	if w := serveFeed("GET", path, http.Header{"If-Modified-Since": {since}}); w.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since after update = %d, want 200", w.Code)
+	}
+}
+
+func TestRssFeed(t *testing.T) {
+	f := addPostsFixture(t, "rss")
+
+	path := fmt.Sprintf("/posts/brand/%d/feed.rss", f.brand.Id)
+	w := serveFeed("GET", path, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s = %d", path, w.Code)
+	}
+
+	var feed rss
+	if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := feed.Channel
+	if feed.Version != "2.0" || ch.Link != fmt.Sprintf("http://example.org/posts/brand/%d/", f.brand.Id) || len(ch.Items) != 2 {
+		t.Fatalf("rss = %+v", feed)
+	}
+
+	if item := ch.Items[1]; item.Guid.Value != f.posts[0].Url || !item.Guid.IsPermaLink || item.PubDate != formatRssTime(f.posts[0].PostTime) {
+		t.Errorf("item = %+v", item)
+	}
+}
+
+func TestFeedNotFound(t *testing.T) {
+	for _, path := range []string{"/posts/user/999999/feed.atom", "/posts/brand/999999/feed.rss"} {
+		if w := serveFeed("GET", path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s = %d, want 404", path, w.Code)
+		}
+	}
+}
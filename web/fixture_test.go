@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"../db"
+)
+
+type postsFixture struct {
+	user  db.User
+	brand db.Brand
+	posts []db.Post
+}
+
+// nameのユーザー(name_user)が銘柄(name_brand)に2件投稿し、1件目が未読
+// テストが終わるとテスト中に登録したデータも含めて全て削除するので、他のテストの件数は変わらない
+func addPostsFixture(t *testing.T, name string) *postsFixture {
+	t.Cleanup(func() { cleanDb(t) })
+
+	f := &postsFixture{
+		user:  db.User{YahooId: name + "_user", Url: "http://example.com/" + name + "_user"},
+		brand: db.Brand{BrandName: name + "_brand", Url: "http://example.com/" + name + "_brand"},
+	}
+
+	base := time.Date(2014, 6, 1, 9, 0, 0, 0, time.UTC)
+
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		if err := db.NewUserRepo(tc).Add(&f.user); err != nil {
+			return err
+		}
+
+		if err := db.NewBrandRepo(tc).Add(&f.brand); err != nil {
+			return err
+		}
+
+		for i := 0; i < 2; i++ {
+			p := db.Post{
+				UserId:    f.user.Id,
+				BrandId:   f.brand.Id,
+				CommentNo: fmt.Sprint(i + 1),
+				Title:     "title",
+				Url:       fmt.Sprintf("http://example.com/%s/%d", name, i+1),
+				Detail:    "detail",
+				PostTime:  base.Add(time.Duration(i) * time.Hour),
+			}
+
+			if _, err := db.NewPostRepo(tc).Save(&p); err != nil {
+				return err
+			}
+
+			f.posts = append(f.posts, p)
+		}
+
+		return db.NewNotificationRepo(tc).AddPost(&db.PostNotification{PostId: f.posts[0].Id})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func cleanDb(t *testing.T) {
+	tables := []string{"alert", "watch_rule", "notification_delivery", "post_notification", "brand_notification", "post_fts", "post", "brand", `"user"`}
+
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		for _, table := range tables {
+			if _, err := tc.Tx.Exec("delete from " + table); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -8,12 +8,12 @@ import (
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	"../db"
+	"../util"
 )
 
 const (
@@ -25,12 +25,28 @@ const (
 	NEW_BRAND_KEEP_DAYS = 3
 )
 
+// クライアントが切断した場合やタイムアウトした場合はSQLを中断する
+const QUERY_TIMEOUT = 10 * time.Second
+
+var (
+	readTx  = &db.TxOptions{ReadOnly: true, Timeout: QUERY_TIMEOUT}
+	writeTx = &db.TxOptions{Timeout: QUERY_TIMEOUT}
+)
+
 type Page struct {
 	Title string
 	*ViewPage
 }
 
 func main() {
+	util.LoadConfig()
+
+	if err := db.Open(); err != nil {
+		log.Fatalln(err)
+	}
+
+	defer db.Close()
+
 	r := mux.NewRouter()
 	r.HandleFunc("/", IndexHandler)
 	r.HandleFunc("/posts/", PostsHandler)
@@ -39,9 +55,15 @@ func main() {
 	r.HandleFunc("/posts/user/{id:[0-9]+}/page/{page:[0-9]+}/", PostsByUserHandler)
 	r.HandleFunc("/posts/brand/{id:[0-9]+}/", PostsByBrandHandler)
 	r.HandleFunc("/posts/brand/{id:[0-9]+}/page/{page:[0-9]+}/", PostsByBrandHandler)
-	r.HandleFunc("/users/", UsersHandler)
+	r.HandleFunc("/search/", SearchHandler)
+	r.HandleFunc("/search/page/{page:[0-9]+}/", SearchHandler)
 	r.HandleFunc("/brands/", BrandsHandler)
 
+	registerUsers(r)
+	registerFeeds(r)
+	registerAlerts(r)
+	registerApi(r)
+
 	http.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("css"))))
 	http.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir("js"))))
 	http.Handle("/fonts/", http.StripPrefix("/fonts/", http.FileServer(http.Dir("fonts"))))
@@ -63,7 +85,22 @@ func LoggingServeMux(handler http.Handler) http.Handler {
 }
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	err := writeOutput(w, "インディックス", "./template/index.tmpl", nil)
+	container := db.NewTxContainer()
+
+	dto := &IndexDto{}
+	err := container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
+		var err error
+		dto.UnseenAlerts, err = db.NewAlertRepo(tc).CountUnseen()
+
+		return err
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = writeOutput(w, "インディックス", "./template/index.tmpl", &ViewPage{Dto: dto})
 	if err != nil {
 		writeError(w, err)
 		return
@@ -89,14 +126,19 @@ func PostsHandler(w http.ResponseWriter, r *http.Request) {
 	var posts []PostDto
 	var total int
 
-	err := container.Do(func(tc *db.TxContainer) error {
+	err := container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
 		var err error
 
 		var ps []db.PostView
-		total, ps, err = NewMyLogic2(tc).getPosts(PER_PAGE, offset)
+		total, ps, err = db.NewPostRepo(tc).List(db.PostFilter{Limit: PER_PAGE, Offset: offset})
 
 		posts = convertPostViewToPostDto(ps)
 
+		// 新着はユーザーごと、銘柄ごとの一覧で表示して既読にするので、全体の一覧では表示しない
+		for i := range posts {
+			posts[i].IsNewPost = false
+		}
+
 		return err
 	})
 
@@ -109,6 +151,7 @@ func PostsHandler(w http.ResponseWriter, r *http.Request) {
 		&ViewPage{
 			Dto:        posts,
 			ReturnPath: "/",
+			FeedPath:   "/posts/feed",
 			Pagination: NewPagination(
 				total,
 				PER_PAGE,
@@ -143,13 +186,11 @@ func PostsByUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	var posts []PostDto
 	var total int
-	err := container.Do(func(tc *db.TxContainer) error {
+	err := container.DoContext(r.Context(), writeTx, func(tc *db.TxContainer) error {
 		var err error
 
-		l := NewMyLogic2(tc)
-
 		var ps []db.PostView
-		total, ps, err = l.getPostsByUserId(id, PER_PAGE, offset)
+		total, ps, err = db.NewPostRepo(tc).List(db.PostFilter{UserId: id, Limit: PER_PAGE, Offset: offset})
 		if err != nil {
 			return err
 		}
@@ -158,7 +199,7 @@ func PostsByUserHandler(w http.ResponseWriter, r *http.Request) {
 
 		ids := getNewPostIds(posts)
 
-		err = l.deletePostNotificationByPostId(ids)
+		err = db.NewNotificationRepo(tc).DeletePosts(ids)
 
 		return err
 	})
@@ -172,6 +213,7 @@ func PostsByUserHandler(w http.ResponseWriter, r *http.Request) {
 		&ViewPage{
 			Dto:        posts,
 			ReturnPath: "/users/",
+			FeedPath:   fmt.Sprintf("/posts/user/%d/feed", id),
 			Pagination: NewPagination(
 				total,
 				PER_PAGE,
@@ -206,13 +248,11 @@ func PostsByBrandHandler(w http.ResponseWriter, r *http.Request) {
 
 	var posts []PostDto
 	var total int
-	err := container.Do(func(tc *db.TxContainer) error {
+	err := container.DoContext(r.Context(), writeTx, func(tc *db.TxContainer) error {
 		var err error
 
-		l := NewMyLogic2(tc)
-
 		var ps []db.PostView
-		total, ps, err = l.getPostsByBrandId(id, PER_PAGE, offset)
+		total, ps, err = db.NewPostRepo(tc).List(db.PostFilter{BrandId: id, Limit: PER_PAGE, Offset: offset})
 		if err != nil {
 			return err
 		}
@@ -221,7 +261,7 @@ func PostsByBrandHandler(w http.ResponseWriter, r *http.Request) {
 
 		ids := getNewPostIds(posts)
 
-		err = l.deletePostNotificationByPostId(ids)
+		err = db.NewNotificationRepo(tc).DeletePosts(ids)
 
 		return err
 	})
@@ -235,6 +275,7 @@ func PostsByBrandHandler(w http.ResponseWriter, r *http.Request) {
 		&ViewPage{
 			Dto:        posts,
 			ReturnPath: "/brands/",
+			FeedPath:   fmt.Sprintf("/posts/brand/%d/feed", id),
 			Pagination: NewPagination(
 				total,
 				PER_PAGE,
@@ -299,13 +340,14 @@ func convertBrandPostTimeViewToBrandDto(bs []db.BrandPostTimeView) []BrandDto {
 
 //var baseTmpl = template.Must(template.ParseFiles("./template/base.tmpl"))
 
+// 取得対象にしたばかりで投稿のないユーザーも表示する
 func UsersHandler(w http.ResponseWriter, r *http.Request) {
 	container := db.NewTxContainer()
 
 	var users []db.UserPostTimeView
-	err := container.Do(func(tc *db.TxContainer) error {
+	err := container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
 		var err error
-		users, err = NewMyLogic2(tc).getUsers()
+		users, err = db.NewUserRepo(tc).List(db.UserFilter{Order: db.UserOrderByLastPost})
 
 		return err
 	})
@@ -326,17 +368,16 @@ func BrandsHandler(w http.ResponseWriter, r *http.Request) {
 	container := db.NewTxContainer()
 
 	var brands []BrandDto
-	err := container.Do(func(tc *db.TxContainer) error {
-		var err error
-
-		l := NewMyLogic2(tc)
-		bs, err := l.getBrands()
+	err := container.DoContext(r.Context(), writeTx, func(tc *db.TxContainer) error {
+		bs, err := db.NewBrandRepo(tc).List(db.BrandFilter{HasPosts: true})
+		if err != nil {
+			return err
+		}
 
 		brands = convertBrandPostTimeViewToBrandDto(bs)
 
-		l.deleteBrandNotification()
-
-		return err
+		// 一定期間表示するには日時を持たせておく
+		return db.NewNotificationRepo(tc).DeleteBrandsBefore(time.Now().AddDate(0, 0, NEW_BRAND_KEEP_DAYS*-1))
 	})
 
 	if err != nil {
@@ -354,7 +395,7 @@ func BrandsHandler(w http.ResponseWriter, r *http.Request) {
 func writeOutput(w http.ResponseWriter, title string, templateName string, data *ViewPage) error {
 	funcMap := template.FuncMap{
 		"formatTime": func(t time.Time) string {
-			return t.In(time.Local).Format("2006-01-02 15:04:05")
+			return t.In(util.DisplayLocation).Format("2006-01-02 15:04:05")
 		},
 		"safehtml": func(text string) template.HTML { return template.HTML(text) },
 	}
@@ -411,162 +452,6 @@ func writeError(w http.ResponseWriter, err error) {
 		http.StatusInternalServerError)
 }
 
-type MyLogic2 struct {
-	tc *db.TxContainer
-}
-
-func NewMyLogic2(tc *db.TxContainer) *MyLogic2 {
-	return &MyLogic2{tc: tc}
-}
-
-func (m *MyLogic2) getPosts(limit int, offset int) (int, []db.PostView, error) {
-	var posts []db.PostView
-
-	sql := "select A.id, A.user_id as UserId, A.brand_id as BrandId, A.comment_no as CommentNo, A.title as Title, A.url as Url, A.ref_no as RefNo, A.ref_url as RefUrl, A.detail as Detail, A.post_time as PostTime, B.brand_name as BrandName, B.url as BrandUrl from post A inner join brand B on A.brand_id = B.id order by A.post_time desc"
-
-	total, err := m.tc.Tx.SelectInt("select count(*) from (" + sql + ")")
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return 0, nil, err
-	}
-
-	_, err = m.tc.Tx.Select(&posts, sql+" limit ? offset ?", limit, offset)
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return 0, nil, err
-	}
-
-	return int(total), posts, nil
-}
-
-func (m *MyLogic2) getPostsByUserId(userId int, limit int, offset int) (int, []db.PostView, error) {
-	var posts []db.PostView
-
-	sql := "select A.id, A.user_id as UserId, A.brand_id as BrandId, A.comment_no as CommentNo, A.title as Title, A.url as Url, A.ref_no as RefNo, A.ref_url as RefUrl, A.detail as Detail, A.post_time as PostTime, B.brand_name as BrandName, B.url as BrandUrl, C.post_id as PostNotificationPostId from post A inner join brand B on A.brand_id = B.id left join post_notification C on A.id = C.post_id where A.user_id=? order by A.post_time desc"
-
-	total, err := m.tc.Tx.SelectInt("select count(*) from ("+sql+")", userId)
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return 0, nil, err
-	}
-
-	_, err = m.tc.Tx.Select(&posts, sql+" limit ? offset ?", userId, limit, offset)
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return 0, nil, err
-	}
-
-	return int(total), posts, nil
-}
-
-func (m *MyLogic2) getPostsByBrandId(brandId int, limit int, offset int) (int, []db.PostView, error) {
-	var posts []db.PostView
-
-	sql := "select A.id, A.user_id as UserId, A.brand_id as BrandId, A.comment_no as CommentNo, A.title as Title, A.url as Url, A.ref_no as RefNo, A.ref_url as RefUrl, A.detail as Detail, A.post_time as PostTime, B.brand_name as BrandName, B.url as BrandUrl, C.post_id as PostNotificationPostId from post A inner join brand B on A.brand_id = B.id left join post_notification C on A.id = C.post_id where A.brand_id=? order by A.post_time desc"
-
-	total, err := m.tc.Tx.SelectInt("select count(*) from ("+sql+")", brandId)
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return 0, nil, err
-	}
-
-	_, err = m.tc.Tx.Select(&posts, sql+" limit ? offset ?", brandId, limit, offset)
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return 0, nil, err
-	}
-
-	return int(total), posts, nil
-}
-
-func (m *MyLogic2) deletePostNotificationByPostId(ids []int) error {
-	// sqlでやるなら
-	// // delete from post_notification where post_id in (select id from post A1 inner join post_notification B1 on A1.id = B1.post_id where A1.brand_id=?)
-	pa := make([]string, 0, len(ids))
-	args := make([]interface{}, 0, len(ids))
-	//for i := 0; i < len(ids); i++ {
-	for _, id := range ids {
-		pa = append(pa, "?")
-		args = append(args, id)
-	}
-
-	sql := "delete from post_notification where post_id in (" + strings.Join(pa, ",") + ")"
-
-	_, err := m.tc.Tx.Exec(sql, args...)
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return err
-	}
-
-	return nil
-}
-
-func (m *MyLogic2) deleteBrandNotification() error {
-	// 一定期間表示するには日時を持たせておく
-	t := time.Now().AddDate(0, 0, NEW_BRAND_KEEP_DAYS*-1)
-	_, err := m.tc.Tx.Exec("delete from brand_notification where post_time<?", t)
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return err
-	}
-
-	return nil
-}
-
-func (m *MyLogic2) getUsers() ([]db.UserPostTimeView, error) {
-	var users []db.UserPostTimeView
-
-	_, err := m.tc.Tx.Select(&users, "select A.id as Id, A.yahoo_id as YahooId, A.display_name as DisplayName, A.url as Url, B.post_time as PostTimeString, B.new_post_count as NewPostCount from user A inner join (select user_id, max(post_time) as post_time, count(B1.post_id) as new_post_count from post A1 left join post_notification B1 on A1.id = B1.post_id group by user_id) B on A.id = B.user_id order by B.post_time desc")
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return nil, err
-	}
-
-	for i, _ := range users {
-		if users[i].PostTimeString.Valid && users[i].PostTimeString.String != "" {
-			t, err := time.ParseInLocation("2006-01-02 15:04:05", users[i].PostTimeString.String, time.UTC)
-			if err != nil {
-				return nil, err
-			} else {
-				users[i].PostTime = t
-			}
-		}
-	}
-
-	return users, nil
-}
-
-func (m *MyLogic2) getBrands() ([]db.BrandPostTimeView, error) {
-	var bs []db.BrandPostTimeView
-
-	_, err := m.tc.Tx.Select(&bs, "select A.id as Id, A.brand_name as BrandName, A.url as Url, B.post_time as PostTimeString, B.new_post_count as NewPostCount, C.brand_id as BrandNotificationBrandId from brand A inner join (select A1.brand_id, max(A1.post_time) as post_time, count(B1.post_id) as new_post_count from post A1 left join post_notification B1 on A1.id = B1.post_id group by brand_id) B on A.id = B.brand_id left join brand_notification C on A.id = C.brand_id order by B.post_time desc")
-	if err != nil {
-		m.tc.Err = err
-		log.Println(err)
-		return nil, err
-	}
-
-	for i, _ := range bs {
-		t, err := time.ParseInLocation("2006-01-02 15:04:05", bs[i].PostTimeString, time.UTC)
-		if err != nil {
-			return nil, err
-		} else {
-			bs[i].PostTime = t
-		}
-	}
-
-	return bs, nil
-}
-
 type PostDto struct {
 	Id        int
 	UserId    int
@@ -597,6 +482,8 @@ type ViewPage struct {
 	ReturnPath string
 	Dto        interface{}
 	Pagination Pagination
+	// 空でない場合はFeedPath.atomとFeedPath.rssをフィードとして案内する
+	FeedPath string
 }
 
 type Pagination struct {
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"../db"
+	"../tokenizer"
+	"../util"
+)
+
+const DATE_FORMAT = "2006-01-02"
+
+type SearchDto struct {
+	Query   string
+	UserId  int
+	BrandId int
+	From    string
+	To      string
+	Error   string
+	// 検索条件が指定された場合のみtrue
+	Searched bool
+	Total    int
+	Posts    []SearchPostDto
+	Users    []db.UserPostTimeView
+	Brands   []db.BrandPostTimeView
+}
+
+// SearchPostDto は検索語を強調表示したタイトルと本文を持つ
+type SearchPostDto struct {
+	PostDto
+	TitleHtml  template.HTML
+	DetailHtml template.HTML
+}
+
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	q := r.URL.Query()
+	container := db.NewTxContainer()
+
+	s, ok := v["page"]
+	if !ok {
+		s = "1"
+	}
+
+	current, _ := strconv.Atoi(s)
+	if current < 1 {
+		log.Printf("invalid page number: %d", current)
+		current = 1
+	}
+	offset := (current - 1) * PER_PAGE
+
+	dto := &SearchDto{
+		Query: strings.TrimSpace(q.Get("q")),
+		From:  q.Get("from"),
+		To:    q.Get("to"),
+	}
+	dto.UserId, _ = strconv.Atoi(q.Get("user"))
+	dto.BrandId, _ = strconv.Atoi(q.Get("brand"))
+
+	f := db.SearchFilter{
+		Query:   dto.Query,
+		UserId:  dto.UserId,
+		BrandId: dto.BrandId,
+		Limit:   PER_PAGE,
+		Offset:  offset,
+	}
+
+	// 日付は表示するタイムゾーンの日付で、toの日も含める
+	var err error
+	f.From, err = parseDate(dto.From)
+	if err == nil {
+		f.To, err = parseDate(dto.To)
+		if !f.To.IsZero() {
+			f.To = f.To.AddDate(0, 0, 1)
+		}
+	}
+
+	if err != nil {
+		dto.Error = "日付はyyyy-mm-ddの形式で指定してください。"
+	} else {
+		dto.Searched = dto.Query != "" || dto.UserId != 0 || dto.BrandId != 0 || dto.From != "" || dto.To != ""
+	}
+
+	err = container.DoContext(r.Context(), readTx, func(tc *db.TxContainer) error {
+		var err error
+
+		dto.Users, err = db.NewUserRepo(tc).List(db.UserFilter{HasPosts: true})
+		if err != nil {
+			return err
+		}
+
+		dto.Brands, err = db.NewBrandRepo(tc).List(db.BrandFilter{HasPosts: true})
+		if err != nil {
+			return err
+		}
+
+		if !dto.Searched {
+			return nil
+		}
+
+		var ps []db.PostView
+		dto.Total, ps, err = db.NewSearchRepo(tc).Search(f)
+		if err != nil {
+			return err
+		}
+
+		terms := f.Terms()
+		for _, p := range convertPostViewToPostDto(ps) {
+			dto.Posts = append(dto.Posts, SearchPostDto{
+				PostDto:    p,
+				TitleHtml:  highlight(p.Title, terms),
+				DetailHtml: highlight(p.Detail, terms),
+			})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// ページのリンクにも検索条件を付ける。printfで使うので%はエスケープする
+	q.Del("page")
+	path := "/search/page/%d/?" + strings.Replace(q.Encode(), "%", "%%", -1)
+
+	err = writeOutput(w, "検索", "./template/search.tmpl",
+		&ViewPage{
+			Dto:        dto,
+			ReturnPath: "/",
+			Pagination: NewPagination(
+				dto.Total,
+				PER_PAGE,
+				DISPLAY_PAGES,
+				current,
+				path,
+			),
+		})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	return time.ParseInLocation(DATE_FORMAT, s, util.DisplayLocation)
+}
+
+// highlight はtextをエスケープし、termsのいずれかに一致する部分を<mark>で囲む
+// 検索と同じように正規化して比較するので、全角と半角やひらがなとカタカナの違いがあっても一致する
+func highlight(text string, terms []string) template.HTML {
+	spans := tokenizer.Spans(text)
+
+	rs := make([]rune, len(spans))
+	for i, sp := range spans {
+		rs[i] = sp.Rune
+	}
+
+	segs := make([][]rune, 0, len(terms))
+	for _, term := range terms {
+		for _, seg := range tokenizer.Segments(term) {
+			segs = append(segs, []rune(seg))
+		}
+	}
+
+	var buf []string
+	pos := 0
+	for i := 0; i < len(rs); {
+		n := longestMatch(rs[i:], segs)
+		if n == 0 {
+			i++
+			continue
+		}
+
+		// 正規化で1文字が複数の文字になった場合は、元の1文字全体を囲む
+		start, end := spans[i].Start, spans[i+n-1].End
+		if start < pos {
+			start = pos
+		}
+
+		if start < end {
+			buf = append(buf, html.EscapeString(text[pos:start]), "<mark>", html.EscapeString(text[start:end]), "</mark>")
+			pos = end
+		}
+
+		i += n
+	}
+
+	buf = append(buf, html.EscapeString(text[pos:]))
+
+	return template.HTML(strings.Join(buf, ""))
+}
+
+func longestMatch(rs []rune, terms [][]rune) int {
+	longest := 0
+
+	for _, t := range terms {
+		if len(t) <= longest || len(t) > len(rs) {
+			continue
+		}
+
+		if string(rs[:len(t)]) == string(t) {
+			longest = len(t)
+		}
+	}
+
+	return longest
+}
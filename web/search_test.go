@@ -0,0 +1,53 @@
+package main
+
+import (
+	"html/template"
+	"testing"
+	"time"
+
+	"../util"
+)
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		text  string
+		terms []string
+		want  template.HTML
+	}{
+		{"決算発表", nil, "決算発表"},
+		{"明日は決算発表", []string{"決算"}, "明日は<mark>決算</mark>発表"},
+		{"Stop high STOP", []string{"stop"}, "<mark>Stop</mark> high <mark>STOP</mark>"},
+		{"ストップ高", []string{"ストップ", "ストップ高"}, "<mark>ストップ高</mark>"},
+		{"<b>決算</b>", []string{"決算"}, "&lt;b&gt;<mark>決算</mark>&lt;/b&gt;"},
+		{"a&b", []string{"a", "b"}, "<mark>a</mark>&amp;<mark>b</mark>"},
+		{"ｽﾄｯﾌﾟ高!", []string{"ストップ"}, "<mark>ｽﾄｯﾌﾟ</mark>高!"},
+		{"ＳＴＯＰ高", []string{"すとっぷ", "stop"}, "<mark>ＳＴＯＰ</mark>高"},
+		{"決算・発表", []string{"決算・発表"}, "<mark>決算</mark>・<mark>発表</mark>"},
+	}
+
+	for _, tt := range tests {
+		if got := highlight(tt.text, tt.terms); got != tt.want {
+			t.Errorf("highlight(%q, %q) = %q, want %q", tt.text, tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	got, err := parseDate("2014-05-20")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := time.Date(2014, 5, 20, 0, 0, 0, 0, util.DisplayLocation)
+	if !got.Equal(want) {
+		t.Errorf("parseDate = %v, want %v", got, want)
+	}
+
+	if got, err := parseDate(""); err != nil || !got.IsZero() {
+		t.Errorf("parseDate(\"\") = %v, %v", got, err)
+	}
+
+	if _, err := parseDate("2014/05/20"); err == nil {
+		t.Error("parseDate(\"2014/05/20\") should fail")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"../db"
+	"../util"
+)
+
+func registerUsers(r *mux.Router) {
+	r.HandleFunc("/users/", UsersHandler)
+	r.HandleFunc("/users/new/", UserEditHandler)
+	r.HandleFunc("/users/{id:[0-9]+}/", UserEditHandler)
+	r.HandleFunc("/users/{id:[0-9]+}/active/", UserActiveHandler)
+}
+
+// UserDto はユーザーの編集画面の入力内容
+type UserDto struct {
+	// 新規作成の場合は0
+	Id          int
+	YahooId     string
+	DisplayName string
+	Url         string
+	Active      bool
+	Error       string
+}
+
+// UserEditHandler はGETで編集画面を表示し、POSTで保存して一覧に戻る
+// 入力内容に誤りがある場合は、エラーと入力内容を編集画面に表示する
+func UserEditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// /users/new/の場合は新規作成
+	s, edit := mux.Vars(r)["id"]
+	id, _ := strconv.Atoi(s)
+	container := db.NewTxContainer()
+
+	dto := &UserDto{Active: true}
+
+	found := true
+	saved := false
+	err := container.DoContext(r.Context(), writeTx, func(tc *db.TxContainer) error {
+		var err error
+
+		repo := db.NewUserRepo(tc)
+
+		user := &db.User{}
+		if edit {
+			user, err = repo.Get(id)
+			if err != nil {
+				return err
+			}
+
+			if user == nil {
+				found = false
+				return nil
+			}
+
+			dto.setUser(user)
+		}
+
+		if r.Method != "POST" {
+			return nil
+		}
+
+		if err = r.ParseForm(); err != nil {
+			dto.Error = "入力内容を読み込めませんでした。"
+			return nil
+		}
+
+		dto.parseForm(r.PostForm)
+		dto.Error, err = dto.validate(tc)
+		if err != nil || dto.Error != "" {
+			return err
+		}
+
+		dto.apply(user)
+
+		if edit {
+			err = repo.Update(user)
+		} else {
+			err = repo.Add(user)
+		}
+
+		saved = err == nil
+
+		return err
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	if saved {
+		http.Redirect(w, r, "/users/", http.StatusSeeOther)
+		return
+	}
+
+	title := "ユーザの追加"
+	if edit {
+		title = "ユーザの編集"
+	}
+
+	err = writeOutput(w, title, "./template/user.tmpl", &ViewPage{Dto: dto, ReturnPath: "/users/"})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+// UserActiveHandler はユーザーを取得対象にするかをactiveの値(1か0)にして一覧に戻る
+// 取得対象から外しても、保存済みの投稿は削除しない
+func UserActiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	active := r.PostFormValue("active") == "1"
+	container := db.NewTxContainer()
+
+	found := true
+	err := container.DoContext(r.Context(), writeTx, func(tc *db.TxContainer) error {
+		repo := db.NewUserRepo(tc)
+
+		user, err := repo.Get(id)
+		if err != nil {
+			return err
+		}
+
+		if user == nil {
+			found = false
+			return nil
+		}
+
+		user.Active = active
+
+		return repo.Update(user)
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Redirect(w, r, "/users/", http.StatusSeeOther)
+}
+
+func (d *UserDto) setUser(user *db.User) {
+	d.Id = user.Id
+	d.YahooId = user.YahooId
+	d.DisplayName = user.DisplayName.String
+	d.Url = user.Url
+	d.Active = user.Active
+}
+
+func (d *UserDto) parseForm(form url.Values) {
+	d.YahooId = strings.TrimSpace(form.Get("yahoo_id"))
+	d.DisplayName = strings.TrimSpace(form.Get("display_name"))
+	d.Url = strings.TrimSpace(form.Get("url"))
+	d.Active = form.Get("active") == "1"
+}
+
+// apply は入力内容をuserに設定する。表示名が空の場合はnullにする
+func (d *UserDto) apply(user *db.User) {
+	user.YahooId = d.YahooId
+	user.DisplayName.String, user.DisplayName.Valid = d.DisplayName, d.DisplayName != ""
+	user.Url = d.Url
+	user.Active = d.Active
+}
+
+// validate は入力内容に誤りがある場合、画面に表示するメッセージを返す
+func (d *UserDto) validate(tc *db.TxContainer) (string, error) {
+	if msg := util.ValidateUser(d.YahooId, d.DisplayName, d.Url); msg != "" {
+		return msg, nil
+	}
+
+	exist, err := db.NewUserRepo(tc).GetByYahooId(d.YahooId)
+	if err != nil {
+		return "", err
+	}
+
+	if exist != nil && exist.Id != d.Id {
+		return fmt.Sprintf("Yahoo ID %s は登録済みです(id : %d)。", d.YahooId, exist.Id), nil
+	}
+
+	return "", nil
+}
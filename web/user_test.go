@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"../db"
+)
+
+func serveUsers(method string, path string, form url.Values) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	registerUsers(r)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestUserEdit(t *testing.T) {
+	f := addPostsFixture(t, "user_edit")
+
+	// 入力内容に誤りがある場合は保存せずに編集画面を表示する
+	for _, tt := range []struct {
+		form url.Values
+		want string
+	}{
+		{url.Values{"url": {"http://example.com/"}}, "Yahoo IDを入力してください。"},
+		{url.Values{"yahoo_id": {"a b"}, "url": {"http://example.com/"}}, "Yahoo IDに空白や記号(/?#&amp;)は使えません。"},
+		{url.Values{"yahoo_id": {"new_user"}, "url": {"example.com/new_user"}}, "URLはhttp://かhttps://で始まる形式で入力してください。"},
+		{url.Values{"yahoo_id": {"new_user"}, "url": {"ftp://example.com/"}}, "URLはhttp://かhttps://で始まる形式で入力してください。"},
+		{url.Values{"yahoo_id": {"new_user"}, "url": {"http://example.com/personal/history/comment?user=new_user"}}, "URLはTextreamのユーザーのページ(http://textream.yahoo.co.jp/personal/history/comment?user=...)を入力してください。"},
+		{url.Values{"yahoo_id": {"new_user"}, "url": {"http://textream.yahoo.co.jp/message/1003436/9bf2a6a5a4b5a4b3a4a6"}}, "URLはTextreamのユーザーのページ(http://textream.yahoo.co.jp/personal/history/comment?user=...)を入力してください。"},
+		{url.Values{"yahoo_id": {"new_user"}, "url": {"http://textream.yahoo.co.jp/personal/history/comment"}}, "URLはTextreamのユーザーのページ(http://textream.yahoo.co.jp/personal/history/comment?user=...)を入力してください。"},
+		{url.Values{"yahoo_id": {"new_user"}, "url": {"http://textream.yahoo.co.jp/personal/history/comment?user=other_user"}}, "URLのユーザー(other_user)がYahoo IDと一致しません。"},
+		{url.Values{"yahoo_id": {"user_edit_user"}, "url": {"http://textream.yahoo.co.jp/personal/history/comment?user=user_edit_user"}}, fmt.Sprintf("Yahoo ID user_edit_user は登録済みです(id : %d)。", f.user.Id)},
+	} {
+		w := serveUsers("POST", "/users/new/", tt.form)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("POST /users/new/ %v = %d\n%s", tt.form, w.Code, w.Body.String())
+		}
+	}
+
+	form := url.Values{
+		"yahoo_id":     {"new_user"},
+		"display_name": {"新規ユーザー"},
+		"url":          {"http://textream.yahoo.co.jp/personal/history/comment?user=new_user"},
+		"active":       {"1"},
+	}
+
+	w := serveUsers("POST", "/users/new/", form)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/users/" {
+		t.Fatalf("POST /users/new/ = %d\n%s", w.Code, w.Body.String())
+	}
+
+	u := findUser(t, "new_user")
+	if u.DisplayName.String != "新規ユーザー" || u.Url != form.Get("url") || !u.Active {
+		t.Errorf("user = %+v", u)
+	}
+
+	// 表示名を空にするとnullになり、チェックボックスを外すと取得対象から外れる
+	path := fmt.Sprintf("/users/%d/", u.Id)
+	form.Set("display_name", "")
+	form.Del("active")
+	if w = serveUsers("POST", path, form); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST %s = %d\n%s", path, w.Code, w.Body.String())
+	}
+
+	u = findUser(t, "new_user")
+	if u.DisplayName.Valid || u.Active {
+		t.Errorf("user = %+v", u)
+	}
+
+	if w = serveUsers("POST", path+"active/", url.Values{"active": {"1"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("POST %sactive/ = %d", path, w.Code)
+	}
+
+	if u = findUser(t, "new_user"); !u.Active {
+		t.Errorf("user = %+v", u)
+	}
+
+	// 投稿のないユーザーも一覧に表示する
+	w = serveUsers("GET", "/users/", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), path) || !strings.Contains(w.Body.String(), "user_edit_user") {
+		t.Errorf("GET /users/ = %d\n%s", w.Code, w.Body.String())
+	}
+
+	w = serveUsers("GET", path, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `value="new_user"`) {
+		t.Errorf("GET %s = %d\n%s", path, w.Code, w.Body.String())
+	}
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{"GET", "/users/0/", http.StatusNotFound},
+		{"POST", "/users/0/active/", http.StatusNotFound},
+		{"GET", path + "active/", http.StatusMethodNotAllowed},
+		{"DELETE", path, http.StatusMethodNotAllowed},
+	} {
+		if w = serveUsers(tt.method, tt.path, nil); w.Code != tt.want {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func findUser(t *testing.T, yahooId string) *db.User {
+	var u *db.User
+	err := db.NewTxContainer().Do(func(tc *db.TxContainer) error {
+		var err error
+		u, err = db.NewUserRepo(tc).GetByYahooId(yahooId)
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u == nil {
+		t.Fatalf("user %s not found", yahooId)
+	}
+
+	return u
+}